@@ -0,0 +1,150 @@
+package yabs
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"golang.org/x/exp/slices"
+)
+
+// actionResult is what's cached for an action key once the task has run
+type actionResult struct {
+	// Checksum is the checksum of the task's output, empty if it had none
+	Checksum string
+	// Remote is set when the result was just fetched from the remote cache
+	Remote bool `json:"-"`
+}
+
+func (y *Yabs) getActionLoc(key string) string {
+	return filepath.Join(y.CacheDir, "actions", key[:2], key[2:])
+}
+
+// digest identifies a finished task's output to its dependents, tasks without
+// an output are identified by their action key instead
+func (t *Task) digest() string {
+	if t.Checksum != "" {
+		return t.Checksum
+	}
+	return "key:" + t.Key
+}
+
+// computeKey records the inputs of t now that its deps have finished and sets
+// its action key from them
+func (t *Task) computeKey(deps []*Task) {
+	t.depDigests = map[string]string{}
+	for _, dep := range deps {
+		t.depDigests[dep.Name] = dep.digest()
+	}
+	t.envDigests = map[string]string{}
+	for _, name := range t.Env {
+		if value, ok := os.LookupEnv(name); ok {
+			sum := sha256.Sum256([]byte(value))
+			t.envDigests[name] = hex.EncodeToString(sum[:])
+		}
+	}
+	t.Key = t.actionKey()
+}
+
+// actionKey hashes everything that goes into running t: its name, its
+// function, the outputs of its deps and its env vars, along with how outputs
+// are checksummed. Toolchain versions are part of their target's name so
+// they're covered by the deps.
+func (t *Task) actionKey() string {
+	h := sha256.New()
+	fmt.Fprintf(h, "checksums v%d\n", checksumVersion)
+	fmt.Fprintf(h, "name %q\n", t.Name)
+	fmt.Fprintf(h, "fn %q\n", t.FnHash)
+	for _, name := range sortedKeys(t.depDigests) {
+		fmt.Fprintf(h, "dep %q %s\n", name, t.depDigests[name])
+	}
+	env := slices.Clone(t.Env)
+	slices.Sort(env)
+	for _, name := range slices.Compact(env) {
+		// unset vars are left empty to tell them apart from empty ones
+		fmt.Fprintf(h, "env %q %s\n", name, t.envDigests[name])
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+	return keys
+}
+
+// lookupAction returns the cached result for an action key, ok is false if the
+// action hasn't been cached or its output has since been removed. The entries
+// are marked as used.
+func (y *Yabs) lookupAction(key string) (res actionResult, ok bool, err error) {
+	res, ok, err = y.readAction(key)
+	if !ok || err != nil {
+		return res, ok, err
+	}
+	if res.Checksum != "" {
+		touch(y.getCacheLoc(res.Checksum))
+	}
+	touch(y.getActionLoc(key))
+	return res, true, nil
+}
+
+// readAction is lookupAction without marking the entries as used
+func (y *Yabs) readAction(key string) (res actionResult, ok bool, err error) {
+	bs, err := os.ReadFile(y.getActionLoc(key))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return res, false, nil
+		}
+		return res, false, fmt.Errorf("reading action: %w", err)
+	}
+	// a corrupt entry is the same as a missing one, it's overwritten once the
+	// task runs again
+	if err := json.Unmarshal(bs, &res); err != nil {
+		return res, false, nil
+	}
+	if res.Checksum != "" {
+		if _, err := os.Stat(y.getCacheLoc(res.Checksum)); err != nil {
+			return res, false, nil
+		}
+	}
+	return res, true, nil
+}
+
+// saveAction caches the result of running an action
+func (y *Yabs) saveAction(key string, res actionResult) error {
+	bs, err := json.Marshal(res)
+	if err != nil {
+		return fmt.Errorf("marshaling action: %w", err)
+	}
+	loc := y.getActionLoc(key)
+	if err := writeAtomic(loc, 0o644, func(w io.Writer) error {
+		_, err := w.Write(bs)
+		return err
+	}); err != nil {
+		return fmt.Errorf("writing action: %w", err)
+	}
+	return nil
+}
+
+// restore points t at the output of a cached action instead of running it
+func (t *Task) restore(y *Yabs, res actionResult) error {
+	t.Checksum = res.Checksum
+	t.Out = ""
+	if res.Checksum == "" {
+		return nil
+	}
+	out, err := y.materialise(res.Checksum)
+	if err != nil {
+		return fmt.Errorf("restoring %q: %w", t.Name, err)
+	}
+	t.Out = out
+	return nil
+}
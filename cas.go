@@ -0,0 +1,446 @@
+package yabs
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+
+	"golang.org/x/exp/slices"
+)
+
+// tree is how an output is stored in the cache, a file output is a tree with
+// a single entry at "."
+type tree struct {
+	Entries []treeEntry
+}
+
+type treeEntry struct {
+	// Path is slash separated and relative to the output
+	Path string
+	Mode fs.FileMode
+	// Digest is the blob holding a regular file's contents
+	Digest string `json:",omitempty"`
+	// Link is the target of a symlink
+	Link string `json:",omitempty"`
+}
+
+// getCacheLoc is where the tree of an output with the checksum is stored
+func (y *Yabs) getCacheLoc(checksum string) string {
+	return filepath.Join(y.CacheDir, "trees", checksum[:2], checksum[2:])
+}
+
+// getBlobLoc is where a file's contents are stored by their sha256
+func (y *Yabs) getBlobLoc(digest string) string {
+	return filepath.Join(y.CacheDir, "blobs", digest[:2], digest[2:])
+}
+
+// getOutLoc is where an output with the checksum is materialised for the
+// targets depending on it
+func (y *Yabs) getOutLoc(checksum string) (string, error) {
+	return filepath.Abs(filepath.Join(y.tmpDir, "out", checksum))
+}
+
+// writeAtomic writes a file next to loc and renames it into place, so
+// concurrent readers never see a partial file. Both are synced so loc has
+// either its old or its new contents after a crash.
+func writeAtomic(loc string, perm fs.FileMode, write func(w io.Writer) error) error {
+	if err := os.MkdirAll(filepath.Dir(loc), os.ModePerm); err != nil {
+		return fmt.Errorf("creating parent dir: %w", err)
+	}
+	f, err := os.CreateTemp(filepath.Dir(loc), ".tmp-")
+	if err != nil {
+		return fmt.Errorf("creating temp file: %w", err)
+	}
+	defer os.Remove(f.Name())
+	if err := write(f); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Chmod(perm); err != nil {
+		f.Close()
+		return fmt.Errorf("chmod: %w", err)
+	}
+	// flushed before the rename so a crash can't leave loc empty
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return fmt.Errorf("syncing temp file: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("closing temp file: %w", err)
+	}
+	if err := os.Rename(f.Name(), loc); err != nil {
+		return fmt.Errorf("renaming temp file: %w", err)
+	}
+	if err := syncDir(filepath.Dir(loc)); err != nil {
+		return fmt.Errorf("syncing parent dir: %w", err)
+	}
+	return nil
+}
+
+// blobPerm is the mode of stored blobs, they're read only so the cache can't
+// be changed through a hardlinked output
+func blobPerm(mode fs.FileMode) fs.FileMode {
+	if mode&0o111 != 0 {
+		return 0o555
+	}
+	return 0o444
+}
+
+// storeBlob copies a file into the cache, returning the digest of its contents
+func (y *Yabs) storeBlob(path string, mode fs.FileMode) (string, error) {
+	src, err := os.Open(path)
+	if err != nil {
+		return "", fmt.Errorf("storing blob: %w", err)
+	}
+	defer src.Close()
+	return y.writeBlob(src, mode)
+}
+
+// writeBlob copies r into the cache, returning the digest of its contents
+func (y *Yabs) writeBlob(r io.Reader, mode fs.FileMode) (string, error) {
+	dir := filepath.Join(y.CacheDir, "blobs")
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return "", fmt.Errorf("creating blob dir: %w", err)
+	}
+	tmp, err := os.CreateTemp(dir, ".tmp-")
+	if err != nil {
+		return "", fmt.Errorf("storing blob: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	h := sha256.New()
+	_, err = io.Copy(io.MultiWriter(tmp, h), r)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return "", fmt.Errorf("storing blob: %w", err)
+	}
+
+	digest := hex.EncodeToString(h.Sum(nil))
+	loc := y.getBlobLoc(digest)
+	if _, err := os.Stat(loc); err == nil {
+		return digest, nil
+	}
+	if err := os.Chmod(tmp.Name(), blobPerm(mode)); err != nil {
+		return "", fmt.Errorf("storing blob: %w", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(loc), os.ModePerm); err != nil {
+		return "", fmt.Errorf("creating parent dir: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), loc); err != nil {
+		return "", fmt.Errorf("storing blob: %w", err)
+	}
+	return digest, nil
+}
+
+// storeTree stores every file of an output as a blob and returns its tree,
+// files whose digest is remembered and already stored aren't copied again
+func (y *Yabs) storeTree(root string) (tree, error) {
+	tr, err := walkTree(root, func(path string, info fs.FileInfo) (string, error) {
+		if digest, ok := y.hashes.lookup(path, info); ok {
+			if _, err := os.Stat(y.getBlobLoc(digest)); err == nil {
+				return digest, nil
+			}
+		}
+		digest, err := y.storeBlob(path, info.Mode())
+		if err != nil {
+			return "", err
+		}
+		y.hashes.remember(path, info, digest)
+		return digest, nil
+	})
+	if err != nil {
+		return tr, fmt.Errorf("storing tree: %w", err)
+	}
+	return tr, nil
+}
+
+// hashWorkers is how many files of an output are hashed at once
+var hashWorkers = runtime.GOMAXPROCS(0)
+
+// walkTree lists every entry of an output, digest gives each regular file's
+// digest and is called for up to hashWorkers files at once
+func walkTree(root string, digest func(path string, info fs.FileInfo) (string, error)) (tree, error) {
+	tr := tree{}
+	files := []int{}
+	infos := []fs.FileInfo{}
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		entry := treeEntry{Path: filepath.ToSlash(rel), Mode: info.Mode()}
+		switch {
+		case info.IsDir():
+		case info.Mode()&fs.ModeSymlink != 0:
+			if entry.Link, err = os.Readlink(path); err != nil {
+				return err
+			}
+		case info.Mode().IsRegular():
+			files = append(files, len(tr.Entries))
+			infos = append(infos, info)
+		default:
+			return fmt.Errorf("%q: unsupported file type %s", rel, info.Mode().Type())
+		}
+		tr.Entries = append(tr.Entries, entry)
+		return nil
+	})
+	if err != nil {
+		return tr, err
+	}
+	err = forEach(len(files), hashWorkers, func(i int) error {
+		entry := &tr.Entries[files[i]]
+		var err error
+		entry.Digest, err = digest(filepath.Join(root, filepath.FromSlash(entry.Path)), infos[i])
+		return err
+	})
+	return tr, err
+}
+
+// forEach calls fn with 0 to n-1 from up to workers goroutines, stopping at
+// the first error
+func forEach(n, workers int, fn func(i int) error) error {
+	if n < workers {
+		workers = n
+	}
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		next     int
+		firstErr error
+	)
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				mu.Lock()
+				i := next
+				next++
+				stop := i >= n || firstErr != nil
+				mu.Unlock()
+				if stop {
+					return
+				}
+				if err := fn(i); err != nil {
+					mu.Lock()
+					if firstErr == nil {
+						firstErr = err
+					}
+					mu.Unlock()
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	return firstErr
+}
+
+// checksum is the checksum of a directory output: each entry's path, type and
+// contents or link target, sorted by path so it doesn't depend on how the tree
+// was walked. Only the executable bit of a file's mode is kept, so the same
+// output built with another umask has the same checksum.
+func (tr tree) checksum() string {
+	entries := slices.Clone(tr.Entries)
+	slices.SortFunc(entries, func(a, b treeEntry) int { return strings.Compare(a.Path, b.Path) })
+	h := sha256.New()
+	for _, entry := range entries {
+		switch {
+		case entry.Mode.IsDir():
+			fmt.Fprintf(h, "dir %q\n", entry.Path)
+		case entry.Mode&fs.ModeSymlink != 0:
+			fmt.Fprintf(h, "link %q %q\n", entry.Path, entry.Link)
+		case entry.Mode&0o111 != 0:
+			fmt.Fprintf(h, "exec %q %s\n", entry.Path, entry.Digest)
+		default:
+			fmt.Fprintf(h, "file %q %s\n", entry.Path, entry.Digest)
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// fileChecksum checksums a file output as a tree of just the file, so making it
+// executable changes its checksum like it does for a file in a directory
+func fileChecksum(digest string, mode fs.FileMode) string {
+	return tree{Entries: []treeEntry{{Path: ".", Mode: mode, Digest: digest}}}.checksum()
+}
+
+// readTree reads the stored tree of an output
+func (y *Yabs) readTree(checksum string) (tree, error) {
+	tr := tree{}
+	bs, err := os.ReadFile(y.getCacheLoc(checksum))
+	if err != nil {
+		return tr, fmt.Errorf("reading tree: %w", err)
+	}
+	if err := json.Unmarshal(bs, &tr); err != nil {
+		return tr, fmt.Errorf("reading tree: %w", err)
+	}
+	return tr, nil
+}
+
+// storeOut adds the task's output to the cache, unless the same output is
+// already cached, and moves it to where outputs with its checksum are kept
+func (y *Yabs) storeOut(t *Task) error {
+	loc := y.getCacheLoc(t.Checksum)
+	if _, err := os.Stat(loc); errors.Is(err, os.ErrNotExist) {
+		tr, err := y.storeTree(t.Out)
+		if err != nil {
+			return err
+		}
+		if err := writeAtomic(loc, 0o444, func(w io.Writer) error {
+			return json.NewEncoder(w).Encode(tr)
+		}); err != nil {
+			return fmt.Errorf("writing tree: %w", err)
+		}
+	} else if err != nil {
+		return fmt.Errorf("stat tree: %w", err)
+	} else {
+		touch(loc)
+	}
+
+	out, err := y.getOutLoc(t.Checksum)
+	if err != nil {
+		return err
+	}
+	if err := placeOut(t.Out, out); err != nil {
+		return err
+	}
+	t.Out = out
+	return nil
+}
+
+// placeOut moves a new output to dst, if dst is already there it has the same
+// contents and the new output is removed instead
+func placeOut(src, dst string) error {
+	if _, err := os.Lstat(dst); err == nil {
+		return removeDir(src)
+	}
+	if err := os.Rename(src, dst); err != nil {
+		// another task placed the same output first
+		if _, statErr := os.Lstat(dst); statErr == nil {
+			return removeDir(src)
+		}
+		return fmt.Errorf("placing out: %w", err)
+	}
+	return nil
+}
+
+// materialise makes sure the output with the checksum is in the out dir,
+// recreating it from the cache if it was removed
+func (y *Yabs) materialise(checksum string) (string, error) {
+	out, err := y.getOutLoc(checksum)
+	if err != nil {
+		return "", err
+	}
+	if _, err := os.Lstat(out); err == nil {
+		return out, nil
+	}
+
+	tr, err := y.readTree(checksum)
+	if err != nil {
+		return "", err
+	}
+	tmp, err := y.newTmpOut()
+	if err != nil {
+		return "", err
+	}
+	dirs := []treeEntry{}
+	// entries are only created in dirs created from the tree, so nothing can be
+	// written through a symlink, and never over an existing path
+	created := map[string]bool{}
+	for _, entry := range tr.Entries {
+		dst := filepath.Join(tmp, filepath.FromSlash(entry.Path))
+		if !fs.ValidPath(entry.Path) || (entry.Path != "." && !created[path.Dir(entry.Path)]) {
+			_ = removeDir(tmp)
+			return "", fmt.Errorf("materialising %q: not in a directory of the output", entry.Path)
+		}
+		switch {
+		case entry.Mode.IsDir():
+			err = os.Mkdir(dst, os.ModePerm)
+			created[entry.Path] = true
+			dirs = append(dirs, entry)
+		case entry.Mode&fs.ModeSymlink != 0:
+			err = os.Symlink(entry.Link, dst)
+		default:
+			err = linkOrCopy(y.getBlobLoc(entry.Digest), dst, entry.Mode.Perm())
+		}
+		if err != nil {
+			_ = removeDir(tmp)
+			return "", fmt.Errorf("materialising %q: %w", entry.Path, err)
+		}
+	}
+	// once everything is created so a read only dir doesn't stop its children
+	// being created
+	for _, entry := range dirs {
+		if err := os.Chmod(filepath.Join(tmp, filepath.FromSlash(entry.Path)), entry.Mode.Perm()); err != nil {
+			return "", fmt.Errorf("materialising %q: %w", entry.Path, err)
+		}
+	}
+
+	if err := placeOut(tmp, out); err != nil {
+		return "", err
+	}
+	return out, nil
+}
+
+// linkOrCopy hardlinks a blob to path, falling back to a copy when the blob's
+// mode doesn't match or it's on another device
+func linkOrCopy(blob, path string, perm fs.FileMode) error {
+	st, err := os.Stat(blob)
+	if err != nil {
+		return err
+	}
+	if st.Mode().Perm() == blobPerm(perm) {
+		return LinkOrCopy(blob, path, perm)
+	}
+	return copyFile(blob, path, perm)
+}
+
+// LinkOrCopy hardlinks src to dst, falling back to copying it with perm when
+// it can't be linked, like when they're on different filesystems
+func LinkOrCopy(src, dst string, perm fs.FileMode) error {
+	if err := os.Link(src, dst); err == nil {
+		return nil
+	}
+	return copyFile(src, dst, perm)
+}
+
+func copyFile(src, dst string, perm fs.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_EXCL|os.O_WRONLY, perm)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Chmod(perm); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
@@ -0,0 +1,361 @@
+package yabs
+
+import (
+	"encoding/json"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRestoreRemovedOut(t *testing.T) {
+	chdirTemp(t)
+
+	runs := 0
+	restored := ""
+	build := func() {
+		y := New()
+		y.Register("gen", []string{}, func(bc BuildCtx) error {
+			runs++
+			if err := os.MkdirAll(filepath.Join(bc.Out, "sub", "empty"), os.ModePerm); err != nil {
+				return err
+			}
+			if err := os.WriteFile(filepath.Join(bc.Out, "sub", "a"), []byte("hi"), 0o644); err != nil {
+				return err
+			}
+			if err := os.WriteFile(filepath.Join(bc.Out, "tool"), []byte("#!/bin/sh"), 0o755); err != nil {
+				return err
+			}
+			return os.Symlink("sub/a", filepath.Join(bc.Out, "link"))
+		})
+		y.Register("default", []string{"gen"}, func(bc BuildCtx) error {
+			restored = bc.GetDep("gen")
+			return nil
+		}, WithAlwaysRun())
+		if err := y.ExecWithDefault("default"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	build()
+	if err := os.RemoveAll(".yabs/out"); err != nil {
+		t.Fatal(err)
+	}
+	build()
+
+	if runs != 1 {
+		t.Fatalf("want \"gen\" to be restored instead of run, ran %d times", runs)
+	}
+	bs, err := os.ReadFile(filepath.Join(restored, "link"))
+	if err != nil || string(bs) != "hi" {
+		t.Fatalf("want link to read %q, got=%q err=%v", "hi", bs, err)
+	}
+	st, err := os.Stat(filepath.Join(restored, "tool"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.Mode()&0o111 == 0 {
+		t.Fatalf("want tool to stay executable, got mode %s", st.Mode())
+	}
+	if _, err := os.Stat(filepath.Join(restored, "sub", "empty")); err != nil {
+		t.Fatalf("want empty dir to be restored: %s", err)
+	}
+}
+
+func TestRerunMissingBlob(t *testing.T) {
+	chdirTemp(t)
+
+	runs := 0
+	build := func() {
+		y := New()
+		y.Register("default", []string{}, func(bc BuildCtx) error {
+			runs++
+			return bc.Run("echo", "hi").StdoutToFile(bc.Out).Exec()
+		})
+		if err := y.ExecWithDefault("default"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	build()
+	for _, dir := range []string{".yabs/out", "cache/blobs"} {
+		if err := os.RemoveAll(dir); err != nil {
+			t.Fatal(err)
+		}
+	}
+	build()
+
+	if runs != 2 {
+		t.Fatalf("want \"default\" to run again once its blob is gone, ran %d times", runs)
+	}
+}
+
+func TestChecksumDir(t *testing.T) {
+	write := func(t *testing.T, dir, name, content string, perm os.FileMode) {
+		t.Helper()
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), perm); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tests := []struct {
+		name   string
+		change func(t *testing.T, dir string)
+	}{
+		{
+			name: "renamed file",
+			change: func(t *testing.T, dir string) {
+				if err := os.Rename(filepath.Join(dir, "a"), filepath.Join(dir, "c")); err != nil {
+					t.Fatal(err)
+				}
+			},
+		},
+		{
+			name: "swapped contents",
+			change: func(t *testing.T, dir string) {
+				write(t, dir, "a", "b", 0o644)
+				write(t, dir, "sub/b", "a", 0o644)
+			},
+		},
+		{
+			name: "executable bit",
+			change: func(t *testing.T, dir string) {
+				if err := os.Chmod(filepath.Join(dir, "a"), 0o755); err != nil {
+					t.Fatal(err)
+				}
+			},
+		},
+		{
+			name: "empty dir",
+			change: func(t *testing.T, dir string) {
+				if err := os.Mkdir(filepath.Join(dir, "empty"), os.ModePerm); err != nil {
+					t.Fatal(err)
+				}
+			},
+		},
+		{
+			name: "symlink target",
+			change: func(t *testing.T, dir string) {
+				if err := os.Remove(filepath.Join(dir, "link")); err != nil {
+					t.Fatal(err)
+				}
+				if err := os.Symlink("a", filepath.Join(dir, "link")); err != nil {
+					t.Fatal(err)
+				}
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			write(t, dir, "a", "a", 0o644)
+			write(t, dir, "sub/b", "b", 0o644)
+			if err := os.Symlink("sub/b", filepath.Join(dir, "link")); err != nil {
+				t.Fatal(err)
+			}
+			before, err := checksumDir(dir, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			tt.change(t, dir)
+			after, err := checksumDir(dir, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if before == after {
+				t.Fatal("want the checksum to change")
+			}
+		})
+	}
+}
+
+func TestFileOutputExecutableBit(t *testing.T) {
+	chdirTemp(t)
+
+	y := New()
+	y.Register("script", []string{}, func(bc BuildCtx) error {
+		return os.WriteFile(bc.Out, []byte("#!/bin/sh"), 0o644)
+	})
+	y.Register("tool", []string{}, func(bc BuildCtx) error {
+		return os.WriteFile(bc.Out, []byte("#!/bin/sh"), 0o755)
+	})
+	y.Register("default", []string{"script", "tool"}, func(bc BuildCtx) error { return nil }, WithAlwaysRun())
+	if err := y.ExecWithDefault("default"); err != nil {
+		t.Fatal(err)
+	}
+
+	script, tool := y.taskKV["script"], y.taskKV["tool"]
+	if script.Checksum == tool.Checksum {
+		t.Fatal("want the executable bit to change a file output's checksum")
+	}
+	st, err := os.Stat(tool.Out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.Mode()&0o111 == 0 {
+		t.Fatalf("want tool to stay executable, got mode %s", st.Mode())
+	}
+}
+
+func TestOldRecordsAreInvalidated(t *testing.T) {
+	chdirTemp(t)
+
+	y := New()
+	y.Register("default", []string{}, func(bc BuildCtx) error {
+		return os.WriteFile(bc.Out, []byte("hi"), 0o644)
+	})
+	if err := y.ExecWithDefault("default"); err != nil {
+		t.Fatal(err)
+	}
+	// records written before checksums were versioned
+	bs, err := os.ReadFile(".yabs/.records.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bs = regexp.MustCompile(`"ChecksumVersion": \d+`).ReplaceAll(bs, []byte(`"ChecksumVersion": 0`))
+	if err := os.WriteFile(".yabs/.records.json", bs, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	y = New()
+	y.Register("default", []string{}, func(bc BuildCtx) error { return nil })
+	if err := y.RestoreTasks(); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := y.records["default"]; ok {
+		t.Fatal("want the old record to be dropped")
+	}
+}
+
+func TestStatCache(t *testing.T) {
+	chdirTemp(t)
+
+	past := time.Now().Add(-time.Hour)
+	for _, name := range []string{"docs/a.md", "docs/b.md"} {
+		if err := os.MkdirAll(filepath.Dir(name), os.ModePerm); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(name, []byte("old"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(name, past, past); err != nil {
+			t.Fatal(err)
+		}
+	}
+	build := func(rehash bool) string {
+		y := New()
+		y.Rehash = rehash
+		if _, err := Fs(y, "docs", []string{"docs/**"}, nil); err != nil {
+			t.Fatal(err)
+		}
+		if err := y.ExecWithDefault("docs"); err != nil {
+			t.Fatal(err)
+		}
+		return y.taskKV["docs"].Checksum
+	}
+
+	first := build(false)
+	// same size and mtime, only a full rehash notices
+	if err := os.WriteFile("docs/a.md", []byte("new"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes("docs/a.md", past, past); err != nil {
+		t.Fatal(err)
+	}
+	if got := build(false); got != first {
+		t.Fatal("want the remembered digest to be used for an unchanged size and mtime")
+	}
+	second := build(true)
+	if second == first {
+		t.Fatal("want a rehash to read the changed file")
+	}
+
+	if err := os.WriteFile("docs/a.md", []byte("old"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes("docs/a.md", past.Add(time.Minute), past.Add(time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if got := build(false); got != first {
+		t.Fatal("want a changed mtime to be rehashed")
+	}
+}
+
+func TestStatCacheRecreatedFile(t *testing.T) {
+	chdirTemp(t)
+
+	past := time.Now().Add(-time.Hour)
+	write := func(content string) fs.FileInfo {
+		if err := os.WriteFile("f", []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes("f", past, past); err != nil {
+			t.Fatal(err)
+		}
+		info, err := os.Stat("f")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return info
+	}
+	c := &statCache{entries: map[string]statEntry{}, now: time.Now()}
+	old := write("old")
+	if _, err := c.digest("f", old); err != nil {
+		t.Fatal(err)
+	}
+
+	// a new file with the old one's inode, size and mtime, like an output
+	// built in a temp dir after the last one was removed
+	if err := os.Remove("f"); err != nil {
+		t.Fatal(err)
+	}
+	info := write("new")
+	if !os.SameFile(old, info) {
+		t.Skip("the inode wasn't reused")
+	}
+	got, err := c.digest("f", info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, _ := checksumFile("f"); got != want {
+		t.Fatal("want a recreated file to be rehashed")
+	}
+}
+
+func TestMaterialiseRefusesToWriteThroughSymlinks(t *testing.T) {
+	chdirTemp(t)
+
+	y := New()
+	digest, err := y.writeBlob(strings.NewReader("hi"), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	outside := t.TempDir()
+	tr := tree{Entries: []treeEntry{
+		{Path: ".", Mode: fs.ModeDir | 0o755},
+		{Path: "x", Mode: fs.ModeSymlink | 0o777, Link: outside},
+		{Path: "x", Mode: fs.ModeDir | 0o755},
+		{Path: "x/f", Mode: 0o644, Digest: digest},
+	}}
+	checksum := tr.checksum()
+	if err := writeAtomic(y.getCacheLoc(checksum), 0o444, func(w io.Writer) error {
+		return json.NewEncoder(w).Encode(tr)
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := y.materialise(checksum); err == nil {
+		t.Fatal("want materialising through a symlink to fail")
+	}
+	if _, err := os.Lstat(filepath.Join(outside, "f")); err == nil {
+		t.Fatal("want nothing written outside the output")
+	}
+}
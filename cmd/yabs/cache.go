@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/jakegut/yabs"
+	"github.com/risor-io/risor/object"
+)
+
+// parseSize parses a size like 10G or 512MB, units are powers of 1024
+func parseSize(s string) (int64, error) {
+	num := strings.TrimSpace(strings.ToUpper(s))
+	num = strings.TrimSuffix(strings.TrimSuffix(num, "B"), "I")
+	mult := int64(1)
+	if num != "" {
+		if i := strings.IndexByte("KMGT", num[len(num)-1]); i >= 0 {
+			mult = int64(1) << (10 * (i + 1))
+			num = num[:len(num)-1]
+		}
+	}
+	n, err := strconv.ParseFloat(num, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %q, expected e.g. 10G or 512M", s)
+	}
+	return int64(n * float64(mult)), nil
+}
+
+// parseAge parses a duration like 14d or 2w, along with the units
+// time.ParseDuration accepts
+func parseAge(s string) (time.Duration, error) {
+	for suffix, unit := range map[string]time.Duration{"d": 24 * time.Hour, "w": 7 * 24 * time.Hour} {
+		if num, ok := strings.CutSuffix(s, suffix); ok {
+			n, err := strconv.ParseFloat(num, 64)
+			if err != nil || n < 0 {
+				return 0, fmt.Errorf("invalid age %q, expected e.g. 14d or 12h", s)
+			}
+			return time.Duration(n * float64(unit)), nil
+		}
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("invalid age %q, expected e.g. 14d or 12h", s)
+	}
+	return d, nil
+}
+
+// cacheLimits parses the limits given to `cache gc` or cache_limit, an empty
+// string is no limit
+func cacheLimits(maxSize, maxAge string) (yabs.CacheLimits, error) {
+	limits := yabs.CacheLimits{}
+	var err error
+	if maxSize != "" {
+		if limits.MaxSize, err = parseSize(maxSize); err != nil {
+			return limits, err
+		}
+	}
+	if maxAge != "" {
+		if limits.MaxAge, err = parseAge(maxAge); err != nil {
+			return limits, err
+		}
+	}
+	return limits, nil
+}
+
+func cacheLimitFunc(y *yabs.Yabs) object.BuiltinFunction {
+	// args: opts map {max_size: string, max_age: string}
+	return func(ctx context.Context, args ...object.Object) object.Object {
+		if len(args) != 1 {
+			return object.NewArgsError("cache_limit", 1, len(args))
+		}
+		optsMap, ok := args[0].(*object.Map)
+		if !ok {
+			return object.Errorf("expected map of options, got=%T", args[0])
+		}
+		var maxSize, maxAge string
+		for _, key := range optsMap.SortedKeys() {
+			value, err := validateString(optsMap.Get(key))
+			if err != nil {
+				return object.Errorf("%s: %s", key, err)
+			}
+			switch key {
+			case "max_size":
+				maxSize = value
+			case "max_age":
+				maxAge = value
+			default:
+				return object.Errorf("unknown option %q", key)
+			}
+		}
+		limits, err := cacheLimits(maxSize, maxAge)
+		if err != nil {
+			return object.NewError(err)
+		}
+		y.CacheLimits = limits
+		return object.Nil
+	}
+}
+
+func printCacheStats(stats yabs.CacheStats) {
+	fmt.Printf("%d outputs, %d actions and %d blobs, taking up %s\n",
+		stats.Outputs, stats.Actions, stats.Blobs, yabs.FormatSize(stats.Size))
+	if stats.Hits+stats.Misses > 0 {
+		fmt.Printf("%d hits and %d misses in the last %d builds, a %.0f%% hit ratio\n",
+			stats.Hits, stats.Misses, stats.Builds, stats.HitRatio()*100)
+	}
+	if len(stats.Biggest) == 0 {
+		return
+	}
+	fmt.Println("\nBIGGEST OUTPUTS:")
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	for _, entry := range stats.Biggest {
+		targets := strings.Join(entry.Targets, ", ")
+		if targets == "" {
+			targets = "-"
+		}
+		fmt.Fprintf(w, "  %s\t%s\t%s\tlast used %s\n",
+			yabs.FormatSize(entry.Size), entry.Checksum[:12], targets, entry.LastUsed.Format(time.DateTime))
+	}
+	w.Flush()
+}
+
+func printTargetHistory(target string, builds []yabs.TargetBuild) {
+	if len(builds) == 0 {
+		fmt.Printf("%q isn't in the build history\n", target)
+		return
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	for _, build := range builds {
+		checksum := "-"
+		if build.Checksum != "" {
+			checksum = build.Checksum
+		}
+		status := "evicted"
+		switch {
+		case build.Failed:
+			status = "failed"
+		case build.Cached:
+			status = "cached"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", build.Time.Format(time.DateTime), checksum, status, build.Reason)
+	}
+	w.Flush()
+}
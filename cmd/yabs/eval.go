@@ -5,9 +5,7 @@ import (
 	"context"
 	"fmt"
 	"io"
-	"log"
 	"os"
-	"os/exec"
 	"strings"
 
 	"github.com/jakegut/yabs"
@@ -50,17 +48,21 @@ func fsFunc(y *yabs.Yabs) object.BuiltinFunction {
 		}
 		globs, err := validateList[string](args[1])
 		if err != nil {
-			object.NewError(err)
+			return object.NewError(err)
 		}
 		exclude := []string{}
 		if len(args) == 3 {
 			var err error
 			exclude, err = validateList[string](args[2])
 			if err != nil {
-				object.NewError(err)
+				return object.NewError(err)
 			}
 		}
-		return object.NewString(yabs.Fs(y, name, globs, exclude))
+		target, err := yabs.Fs(y, name, globs, exclude)
+		if err != nil {
+			return object.NewError(err)
+		}
+		return object.NewString(target)
 	}
 }
 
@@ -87,7 +89,7 @@ func sh(ctx context.Context, args ...object.Object) object.Object {
 		stderr = prefixer.New(targetName, os.Stderr)
 	}
 
-	cmd := exec.Command("sh", "-c", cmdStr)
+	cmd := yabs.CommandContext(ctx, "sh", "-c", cmdStr)
 	cmd.Stdout = stdout
 	cmd.Stderr = stderr
 	cmd.Env = os.Environ()
@@ -121,7 +123,7 @@ func goTcFunc(y *yabs.Yabs) object.BuiltinFunction {
 		}
 		version, err := validateString(args[0])
 		if err != nil {
-			object.NewError(err)
+			return object.NewError(err)
 		}
 		return object.NewString(toolchain.Go(y, version))
 	}
@@ -134,21 +136,90 @@ func nodeTcFunc(y *yabs.Yabs) object.BuiltinFunction {
 		}
 		version, err := validateString(args[0])
 		if err != nil {
-			object.NewError(err)
+			return object.NewError(err)
 		}
 		return object.NewString(toolchain.Node(y, version))
 	}
 }
 
+// taskOpts converts the options map passed to register into task options
+// opts: {weight: int, resources: []string, env: []string, always: bool}
+func taskOpts(obj object.Object) ([]yabs.TaskOption, error) {
+	optsMap, ok := obj.(*object.Map)
+	if !ok {
+		return nil, fmt.Errorf("expected map of options, got=%T", obj)
+	}
+	opts := []yabs.TaskOption{}
+	for _, key := range optsMap.SortedKeys() {
+		value := optsMap.Get(key)
+		switch key {
+		case "weight":
+			weight, err := validateInt(value)
+			if err != nil {
+				return nil, fmt.Errorf("weight: %w", err)
+			}
+			if weight < 1 {
+				return nil, fmt.Errorf("weight must be at least 1, got %d", weight)
+			}
+			opts = append(opts, yabs.WithWeight(weight))
+		case "resources":
+			resources, err := validateList[string](value)
+			if err != nil {
+				return nil, fmt.Errorf("resources: %w", err)
+			}
+			opts = append(opts, yabs.WithResources(resources...))
+		case "env":
+			env, err := validateList[string](value)
+			if err != nil {
+				return nil, fmt.Errorf("env: %w", err)
+			}
+			opts = append(opts, yabs.WithEnv(env...))
+		case "always":
+			always, err := validateBool(value)
+			if err != nil {
+				return nil, fmt.Errorf("always: %w", err)
+			}
+			if always {
+				opts = append(opts, yabs.WithAlwaysRun())
+			}
+		default:
+			return nil, fmt.Errorf("unknown option %q", key)
+		}
+	}
+	return opts, nil
+}
+
+func resourceFunc(y *yabs.Yabs) object.BuiltinFunction {
+	// args: name string, capacity int
+	return func(ctx context.Context, args ...object.Object) object.Object {
+		if len(args) != 2 {
+			return object.NewArgsError("resource", 2, len(args))
+		}
+		name, err := validateString(args[0])
+		if err != nil {
+			return object.NewError(err)
+		}
+		capacity, err := validateInt(args[1])
+		if err != nil {
+			return object.NewError(err)
+		}
+		if capacity < 1 {
+			return object.Errorf("capacity must be at least 1, got %d", capacity)
+		}
+		y.Resource(name, capacity)
+		return object.NewString(name)
+	}
+}
+
 func registerFunc(y *yabs.Yabs) object.BuiltinFunction {
-	// args: name string, deps []string, task func(bc BuildCtx)
+	// args: name string, deps []string, task func(bc BuildCtx), opts map (optional)
 	return func(ctx context.Context, args ...object.Object) object.Object {
-		if len(args) != 3 {
-			return object.NewArgsError("register", 3, len(args))
+		if len(args) < 3 || len(args) > 4 {
+			return object.NewArgsRangeError("register", 3, 4, len(args))
 		}
 		target, err := validateString(args[0])
 		if err != nil {
-			object.NewError(err)
+			return object.NewError(err)
 		}
 		deps, err := validateList[string](args[1])
 		if err != nil {
@@ -158,15 +229,36 @@ func registerFunc(y *yabs.Yabs) object.BuiltinFunction {
 		if !ok {
 			return object.NewError(fmt.Errorf("wrong type for second arg, want=func(bc), got=%T", args[2]))
 		}
-		y.Register(target, deps, func(bc yabs.BuildCtx) {
+		opts := []yabs.TaskOption{}
+		if len(args) == 4 {
+			var err error
+			opts, err = taskOpts(args[3])
+			if err != nil {
+				return object.NewError(fmt.Errorf("register %q: %w", target, err))
+			}
+		}
+		if locs, ok := ctx.Value(registerLocsKey).(registerLocs); ok {
+			if loc, ok := locs.lookup(target, taskFnObj); ok {
+				opts = append(opts, yabs.WithLocation(loc))
+			}
+		}
+		if fns, ok := ctx.Value(registerFnsKey).(registeredFns); ok {
+			if _, ok := fns[target]; !ok {
+				fns[target] = taskFnObj
+			}
+		}
+		y.Register(target, deps, func(bc yabs.BuildCtx) error {
 			newVM, ok := ctx.Value(vmFuncKey).(VmFunc)
 			if !ok {
-				log.Fatalf("vm not found")
+				return fmt.Errorf("vm not found")
 			}
 			machine := newVM()
 
-			if err := machine.Run(ctx); err != nil {
-				log.Fatal(err)
+			// run under the build's context so the target is stopped when the build is
+			callCtx := context.WithValue(bc.Context(), targetNameKey, target)
+
+			if err := machine.Run(callCtx); err != nil {
+				return err
 			}
 
 			// callFunc, ok := object.GetCallFunc(ctx)
@@ -176,16 +268,15 @@ func registerFunc(y *yabs.Yabs) object.BuiltinFunction {
 
 			bcProxy, err := object.NewProxy(&bc)
 			if err != nil {
-				log.Fatalf("creating new proxy; %s", err)
+				return fmt.Errorf("creating new proxy; %w", err)
 			}
 
-			ctx = context.WithValue(ctx, targetNameKey, target)
-
-			_, err = machine.CallFunction(ctx, taskFnObj, []object.Object{bcProxy})
+			_, err = machine.CallFunction(callCtx, taskFnObj, []object.Object{bcProxy})
 			if err != nil {
-				log.Fatalf("calling func for target %q: %s", target, err)
+				return fmt.Errorf("calling func for target %q: %w", target, err)
 			}
-		})
+			return nil
+		}, opts...)
 		return object.NewString(target)
 	}
 }
@@ -196,6 +287,10 @@ const vmFuncKey = contextKey("yabs:vmfunc")
 
 const targetNameKey = contextKey("yabs:targetname")
 
+const registerLocsKey = contextKey("yabs:registerlocs")
+
+const registerFnsKey = contextKey("yabs:registerfns")
+
 type VmFunc func() *vm.VirtualMachine
 
 func newVMFunc(code *object.Code, builtins map[string]object.Object) VmFunc {
@@ -221,11 +316,13 @@ func getBuiltins(bs *yabs.Yabs) map[string]object.Object {
 		"fmt":     modFmt.Module(),
 		"image":   modImage.Module(),
 		// custom builtins
-		"register": object.NewBuiltin("register", registerFunc(bs)),
-		"sh":       object.NewBuiltin("sh", sh),
-		"fs":       object.NewBuiltin("fs", fsFunc(bs)),
-		"go":       object.NewBuiltin("go", goTcFunc(bs)),
-		"node":     object.NewBuiltin("node", nodeTcFunc(bs)),
+		"register":    object.NewBuiltin("register", registerFunc(bs)),
+		"resource":    object.NewBuiltin("resource", resourceFunc(bs)),
+		"cache_limit": object.NewBuiltin("cache_limit", cacheLimitFunc(bs)),
+		"sh":          object.NewBuiltin("sh", sh),
+		"fs":          object.NewBuiltin("fs", fsFunc(bs)),
+		"go":          object.NewBuiltin("go", goTcFunc(bs)),
+		"node":        object.NewBuiltin("node", nodeTcFunc(bs)),
 	}
 	if awsMod := modAws.Module(); awsMod != nil {
 		allBuiltins["aws"] = awsMod
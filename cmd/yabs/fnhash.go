@@ -0,0 +1,122 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+
+	"github.com/risor-io/risor/object"
+)
+
+// registeredFns maps each target to the function it was registered with, so
+// they can be hashed once build.yb has been evaluated
+type registeredFns map[string]*object.Function
+
+// hashFn identifies a task function by its source, its default arguments, the
+// values it captured from enclosing functions and the globals it uses, so
+// editing any of them reruns the target. Functions it uses are identified the
+// same way, so editing a helper reruns the targets that call it, as are build
+// files it imports.
+func hashFn(fn *object.Function) string {
+	h := sha256.New()
+	writeFn(h, fn, map[object.Object]int{})
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// writeFn writes what identifies fn, seen numbers the functions and modules
+// already written so recursive ones are only written once
+func writeFn(w io.Writer, fn *object.Function, seen map[object.Object]int) {
+	if n, ok := seen[fn]; ok {
+		fmt.Fprintf(w, "seen %d\n", n)
+		return
+	}
+	seen[fn] = len(seen)
+	code := fn.Code()
+	fmt.Fprintf(w, "source %q\n", code.Source)
+	for i, def := range fn.Defaults() {
+		if def != nil {
+			fmt.Fprintf(w, "default %d ", i)
+			writeValue(w, def, seen)
+		}
+	}
+	for i, cell := range fn.FreeVars() {
+		fmt.Fprintf(w, "free %d ", i)
+		writeValue(w, cell.Value(), seen)
+	}
+
+	globals := code.Globals()
+	root := code.Symbols.Root()
+	for _, name := range code.Symbols.AccessedNames() {
+		// a local shadowing a global
+		if _, ok := code.Symbols.Get(name); ok {
+			continue
+		}
+		sym, ok := root.Get(name)
+		if !ok || int(sym.Index) >= len(globals) {
+			continue
+		}
+		writeGlobal(w, name, globals[sym.Index], seen)
+	}
+	fmt.Fprintln(w, "end")
+}
+
+// writeModule writes every global of a module imported from a build file, its
+// attributes can be used without being named in the importing code
+func writeModule(w io.Writer, mod *object.Module, seen map[object.Object]int) {
+	if n, ok := seen[mod]; ok {
+		fmt.Fprintf(w, "seen %d\n", n)
+		return
+	}
+	seen[mod] = len(seen)
+	fmt.Fprintf(w, "module %q\n", mod.Name().Value())
+	code := mod.Code()
+	globals := code.Globals()
+	for _, name := range code.Symbols.InsertedNames() {
+		sym, ok := code.Symbols.Get(name)
+		if !ok || int(sym.Index) >= len(globals) {
+			continue
+		}
+		writeGlobal(w, name, globals[sym.Index], seen)
+	}
+	fmt.Fprintln(w, "end")
+}
+
+func writeGlobal(w io.Writer, name string, obj object.Object, seen map[object.Object]int) {
+	switch obj := obj.(type) {
+	case *object.Builtin:
+		// part of yabs rather than the build file
+		return
+	case *object.Module:
+		if !fromBuildFile(obj) {
+			return
+		}
+	}
+	fmt.Fprintf(w, "global %q ", name)
+	writeValue(w, obj, seen)
+}
+
+// fromBuildFile reports whether a module was compiled from an imported build
+// file, rather than being one of the modules made from Go values
+func fromBuildFile(mod *object.Module) bool {
+	return len(mod.Code().Instructions) > 0
+}
+
+func writeValue(w io.Writer, obj object.Object, seen map[object.Object]int) {
+	switch obj := obj.(type) {
+	case nil:
+		fmt.Fprintln(w, "nil")
+	case *object.Function:
+		fmt.Fprintln(w, "function")
+		writeFn(w, obj, seen)
+	case *object.Module:
+		if !fromBuildFile(obj) {
+			fmt.Fprintf(w, "%s %q\n", obj.Type(), obj.Inspect())
+			return
+		}
+		fmt.Fprintln(w, "module")
+		writeModule(w, obj, seen)
+	default:
+		fmt.Fprintf(w, "%s %q\n", obj.Type(), obj.Inspect())
+	}
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/jakegut/yabs"
+)
+
+// hashTarget evaluates a build file and hashes the function target was
+// registered with
+func hashTarget(t *testing.T, source, target string) string {
+	t.Helper()
+	ctx := context.Background()
+	builtins := getBuiltins(yabs.New())
+	code, err := compile(ctx, source, builtins)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fns := registeredFns{}
+	ctx = context.WithValue(ctx, registerFnsKey, fns)
+	if err := eval(ctx, code, builtins); err != nil {
+		t.Fatal(err)
+	}
+	fn, ok := fns[target]
+	if !ok {
+		t.Fatalf("%q wasn't registered", target)
+	}
+	return hashFn(fn)
+}
+
+func TestHashFn(t *testing.T) {
+	const source = `
+tags := "TAGS"
+flags := "FLAGS"
+func helper() {
+	return "go build " + flags
+}
+func make_task(name) {
+	return func(bc) {
+		sh("CMD " + name + " " + tags + " > " + bc.Out)
+		sh(helper())
+	}
+}
+register("build", [], make_task("NAME"))
+register("other", [], func(bc) { sh("OTHER") })
+`
+	values := map[string]string{
+		"CMD":   "echo",
+		"NAME":  "build",
+		"TAGS":  "-tags=dev",
+		"FLAGS": "-v",
+		"OTHER": "echo other",
+	}
+	// withValue is the build file with one of its values changed
+	withValue := func(name, value string) string {
+		replacements := []string{}
+		for k, v := range values {
+			if k == name {
+				v = value
+			}
+			replacements = append(replacements, k, v)
+		}
+		return strings.NewReplacer(replacements...).Replace(source)
+	}
+
+	tests := []struct {
+		name    string
+		value   string
+		to      string
+		changed bool
+	}{
+		{name: "sh string in the callback", value: "CMD", to: "printf", changed: true},
+		{name: "captured value", value: "NAME", to: "release", changed: true},
+		{name: "global read by the callback", value: "TAGS", to: "-tags=prod", changed: true},
+		{name: "global read by a helper", value: "FLAGS", to: "-race", changed: true},
+		{name: "unrelated target", value: "OTHER", to: "echo something else", changed: false},
+	}
+
+	want := hashTarget(t, withValue("", ""), "build")
+	if got := hashTarget(t, withValue("", ""), "build"); got != want {
+		t.Fatal("want the same build file to hash the same")
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := hashTarget(t, withValue(tt.value, tt.to), "build")
+			if tt.changed && got == want {
+				t.Fatal("want the hash changed")
+			}
+			if !tt.changed && got != want {
+				t.Fatal("want the hash unchanged")
+			}
+		})
+	}
+}
+
+func TestHashFnImportedModule(t *testing.T) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if err := os.Chdir(wd); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	source := `
+import helper
+register("build", [], func(bc) { sh("echo " + helper.msg() + " > " + bc.Out) })
+`
+	hashWith := func(helper string) string {
+		if err := os.WriteFile("helper.yb", []byte(helper), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		return hashTarget(t, source, "build")
+	}
+	want := hashWith(`func msg() { return "one" }`)
+	if got := hashWith(`func msg() { return "one" }`); got != want {
+		t.Fatal("want the same imported build file to hash the same")
+	}
+	if got := hashWith(`func msg() { return "two" }`); got == want {
+		t.Fatal("want editing a function in an imported build file to change the hash")
+	}
+	if got := hashWith("word := \"one\"\nfunc msg() { return word }"); got == hashWith("word := \"two\"\nfunc msg() { return word }") {
+		t.Fatal("want editing a global in an imported build file to change the hash")
+	}
+}
+
+func TestHashFnRecursiveHelper(t *testing.T) {
+	source := `
+func count(n) {
+	if n == 0 {
+		return "done"
+	}
+	return count(n - 1)
+}
+register("build", [], func(bc) { sh("echo " + count(3)) })
+`
+	// the helper refers to itself, hashing it has to end
+	if hashTarget(t, source, "build") == "" {
+		t.Fatal("want a hash")
+	}
+}
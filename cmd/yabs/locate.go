@@ -0,0 +1,192 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/risor-io/risor/ast"
+	"github.com/risor-io/risor/lexer"
+	"github.com/risor-io/risor/object"
+	"github.com/risor-io/risor/parser"
+)
+
+// registerLocs is where each register() call is in the build file
+type registerLocs struct {
+	// fns locates the calls passed a function literal by the literal's
+	// compiled code, which every target registered by the same call shares
+	fns map[*object.Code]string
+	// names locates the calls naming their target with a string, for
+	// functions made by a helper rather than written in the call
+	names map[string]string
+}
+
+// lookup finds where the target registered with fn was registered
+func (l registerLocs) lookup(target string, fn *object.Function) (string, bool) {
+	if loc, ok := l.fns[fn.Code()]; ok {
+		return loc, true
+	}
+	loc, ok := l.names[target]
+	return loc, ok
+}
+
+// locateRegisterCalls parses the build file to find where each target is
+// registered, code is the build file compiled from the same source
+func locateRegisterCalls(ctx context.Context, file, source string, code *object.Code) (registerLocs, error) {
+	// the lexer is given the file itself, parser.WithFile only reaches it after
+	// the first tokens are read
+	program, err := parser.New(lexer.New(source, lexer.WithFile(file))).Parse(ctx)
+	if err != nil {
+		return registerLocs{}, err
+	}
+	return findRegisterCalls(program, code), nil
+}
+
+// compiledFuncs lists the code of every function compiled into code, each
+// followed by the functions inside it, which is the order they're in the
+// source
+func compiledFuncs(code *object.Code) []*object.Code {
+	codes := []*object.Code{}
+	for _, constant := range code.Constants {
+		if fn, ok := constant.(*object.Function); ok {
+			codes = append(codes, fn.Code())
+			codes = append(codes, compiledFuncs(fn.Code())...)
+		}
+	}
+	return codes
+}
+
+// findRegisterCalls walks the program looking for
+// `register(name, deps, func(bc){...})` calls
+func findRegisterCalls(program *ast.Program, code *object.Code) registerLocs {
+	locs := registerLocs{fns: map[*object.Code]string{}, names: map[string]string{}}
+	// every function in the order they're in the source, and where the
+	// register() call is for the ones passed to one
+	funcs := []*ast.Func{}
+	fnLocs := map[*ast.Func]string{}
+	var walk func(node ast.Node)
+	walkAll := func(nodes []ast.Node) {
+		for _, node := range nodes {
+			walk(node)
+		}
+	}
+	walkExprs := func(exprs []ast.Expression) {
+		for _, expr := range exprs {
+			walk(expr)
+		}
+	}
+	walk = func(node ast.Node) {
+		switch node := node.(type) {
+		case nil:
+		case *ast.Program:
+			walkAll(node.Statements())
+		case *ast.Block:
+			if node != nil {
+				walkAll(node.Statements())
+			}
+		case *ast.Call:
+			args := node.Arguments()
+			if ident, ok := node.Function().(*ast.Ident); ok && ident.Literal() == "register" && len(args) >= 3 {
+				pos := node.Token().StartPosition
+				loc := fmt.Sprintf("%s:%d", pos.File, pos.LineNumber())
+				if fn, ok := args[2].(*ast.Func); ok {
+					fnLocs[fn] = loc
+				}
+				// a target registered twice keeps its first registration
+				if name, ok := args[0].(*ast.String); ok {
+					if _, ok := locs.names[name.Value()]; !ok {
+						locs.names[name.Value()] = loc
+					}
+				}
+			}
+			walk(node.Function())
+			walkAll(args)
+		case *ast.Func:
+			funcs = append(funcs, node)
+			for _, expr := range node.Defaults() {
+				walk(expr)
+			}
+			walk(node.Body())
+		case *ast.Var:
+			_, value := node.Value()
+			walk(value)
+		case *ast.MultiVar:
+			_, value := node.Value()
+			walk(value)
+		case *ast.Const:
+			_, value := node.Value()
+			walk(value)
+		case *ast.Assign:
+			walk(node.Value())
+		case *ast.Control:
+			walk(node.Value())
+		case *ast.For:
+			walk(node.Init())
+			walk(node.Condition())
+			walk(node.Post())
+			walk(node.Consequence())
+		case *ast.If:
+			walk(node.Condition())
+			walk(node.Consequence())
+			walk(node.Alternative())
+		case *ast.Ternary:
+			walkExprs([]ast.Expression{node.Condition(), node.IfTrue(), node.IfFalse()})
+		case *ast.Switch:
+			walk(node.Value())
+			for _, choice := range node.Choices() {
+				walkExprs(choice.Expressions())
+				walk(choice.Block())
+			}
+		case *ast.Pipe:
+			walkExprs(node.Expressions())
+		case *ast.ObjectCall:
+			walk(node.Object())
+			walk(node.Call())
+		case *ast.GetAttr:
+			walk(node.Object())
+		case *ast.Prefix:
+			walk(node.Right())
+		case *ast.Infix:
+			walk(node.Left())
+			walk(node.Right())
+		case *ast.In:
+			walk(node.Left())
+			walk(node.Right())
+		case *ast.Range:
+			walk(node.Container())
+		case *ast.Index:
+			walk(node.Left())
+			walk(node.Index())
+		case *ast.Slice:
+			walkExprs([]ast.Expression{node.Left(), node.FromIndex(), node.ToIndex()})
+		case *ast.List:
+			walkExprs(node.Items())
+		case *ast.Set:
+			walkExprs(node.Items())
+		case *ast.Map:
+			for key, value := range node.Items() {
+				walk(key)
+				walk(value)
+			}
+		}
+	}
+	walk(program)
+
+	// the compiled code doesn't know where it's from, functions are matched to
+	// it by their source, in order for ones with the same source
+	codes := map[string][]*object.Code{}
+	for _, c := range compiledFuncs(code) {
+		codes[c.Source] = append(codes[c.Source], c)
+	}
+	for _, fn := range funcs {
+		source := fn.Body().String()
+		if len(codes[source]) == 0 {
+			continue
+		}
+		c := codes[source][0]
+		codes[source] = codes[source][1:]
+		if loc, ok := fnLocs[fn]; ok {
+			locs.fns[c] = loc
+		}
+	}
+	return locs
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/jakegut/yabs"
+)
+
+// locateTargets evaluates a build file whose targets all depend on a missing
+// target, returning where the unknown dep error says each was registered
+func locateTargets(t *testing.T, source string) map[string]string {
+	t.Helper()
+	ctx := context.Background()
+	y := yabs.New()
+	builtins := getBuiltins(y)
+	code, err := compile(ctx, source, builtins)
+	if err != nil {
+		t.Fatal(err)
+	}
+	locs, err := locateRegisterCalls(ctx, "build.yb", source, code)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx = context.WithValue(ctx, registerLocsKey, locs)
+	if err := eval(ctx, code, builtins); err != nil {
+		t.Fatal(err)
+	}
+
+	got := map[string]string{}
+	for _, target := range y.GetTaskNames() {
+		var depErr *yabs.UnknownDepError
+		if err := y.Validate(target); !errors.As(err, &depErr) {
+			t.Fatalf("want an unknown dep error for %q, got %v", target, err)
+		}
+		got[target] = depErr.Loc
+	}
+	return got
+}
+
+func TestLocateRegisterCalls(t *testing.T) {
+	tests := []struct {
+		name   string
+		source string
+		want   map[string]string
+	}{
+		{
+			name: "same function body",
+			source: `
+register("a", ["missing"], func(bc) { sh("echo hi") })
+
+register("b", ["missing"], func(bc) { sh("echo hi") })
+`,
+			want: map[string]string{"a": "build.yb:2", "b": "build.yb:4"},
+		},
+		{
+			name:   "first line",
+			source: `register("a", ["missing"], func(bc) { sh("echo hi") })`,
+			want:   map[string]string{"a": "build.yb:1"},
+		},
+		{
+			name: "function made by a helper",
+			source: `
+func make_task(msg) {
+	return func(bc) { sh("echo " + msg) }
+}
+register("a", ["missing"], make_task("a"))
+register("b", ["missing"], make_task("b"))
+`,
+			want: map[string]string{"a": "build.yb:5", "b": "build.yb:6"},
+		},
+		{
+			name: "registered by a helper",
+			source: `
+func go_binary(name) {
+	register(name, ["missing"], func(bc) { sh("go build -o " + bc.Out) })
+}
+go_binary("a")
+go_binary("b")
+register("c", ["missing"], func(bc) { sh("go build -o " + bc.Out) })
+`,
+			want: map[string]string{"a": "build.yb:3", "b": "build.yb:3", "c": "build.yb:7"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := locateTargets(t, tt.source)
+			if len(got) != len(tt.want) {
+				t.Fatalf("want %d targets, got %v", len(tt.want), got)
+			}
+			for target, loc := range tt.want {
+				if got[target] != loc {
+					t.Errorf("want %q located at %q, got %q", target, loc, got[target])
+				}
+			}
+		})
+	}
+}
@@ -3,10 +3,18 @@ package main
 import (
 	"bytes"
 	"context"
+	"errors"
 	"fmt"
+	"io"
+	"io/fs"
 	"log"
+	"net/http"
 	"os"
+	"os/signal"
+	"runtime"
 	"runtime/pprof"
+	"syscall"
+	"time"
 
 	"github.com/jakegut/yabs"
 	"github.com/urfave/cli/v2"
@@ -29,13 +37,59 @@ func getAvailableTargets(bs *yabs.Yabs) string {
 	return buffer.String()
 }
 
-func main() {
+func printCriticalPath(bs *yabs.Yabs, targets []string) {
+	path := bs.CriticalPath(targets...)
+	var total time.Duration
+	for _, step := range path {
+		total += step.Duration
+	}
+	log.Printf("critical path, estimated %s:", total.Round(time.Millisecond))
+	for _, step := range path {
+		log.Printf("\t%s %s", step.Target, step.Duration.Round(time.Millisecond))
+	}
+}
 
-	bs := yabs.New()
+func printPlan(plan []yabs.PlannedTask) {
+	toRun := []yabs.PlannedTask{}
+	fromRemote := []yabs.PlannedTask{}
+	for _, task := range plan {
+		switch {
+		case task.Reason.Dirty():
+			toRun = append(toRun, task)
+		case task.Reason.Kind == yabs.RemoteCached:
+			fromRemote = append(fromRemote, task)
+		}
+	}
+	fmt.Printf("would run %d of %d targets:\n", len(toRun), len(plan))
+	for _, task := range toRun {
+		fmt.Printf("\t%s: %s\n", task.Target, task.Reason)
+	}
+	if len(fromRemote) > 0 {
+		fmt.Printf("would restore %d targets from remote:\n", len(fromRemote))
+		for _, task := range fromRemote {
+			fmt.Printf("\t%s\n", task.Target)
+		}
+	}
+}
+
+func printExplanations(explanations []yabs.Explanation) {
+	for _, e := range explanations {
+		switch {
+		case !e.Recorded:
+			fmt.Printf("%q has no record of a previous build\n", e.Target)
+		case e.Reason.Dirty():
+			fmt.Printf("%q ran: %s\n", e.Target, e.Reason)
+		default:
+			fmt.Printf("%q was skipped: %s\n", e.Target, e.Reason)
+		}
+	}
+}
 
+// evalBuildFile evaluates build.yb, registering its targets with bs
+func evalBuildFile(bs *yabs.Yabs) error {
 	fileContent, err := os.ReadFile("build.yb")
 	if err != nil {
-		log.Fatalf("reading: %s", err)
+		return fmt.Errorf("reading: %w", err)
 	}
 
 	ctx := context.Background()
@@ -44,26 +98,60 @@ func main() {
 
 	code, err := compile(ctx, string(fileContent), builtins)
 	if err != nil {
-		log.Fatalf("compiling: %s", err)
+		return fmt.Errorf("compiling: %w", err)
 	}
 
 	ctx = context.WithValue(ctx, vmFuncKey, newVMFunc(code, builtins))
 
+	locs, err := locateRegisterCalls(ctx, "build.yb", string(fileContent), code)
+	if err != nil {
+		return fmt.Errorf("locating targets: %w", err)
+	}
+	ctx = context.WithValue(ctx, registerLocsKey, locs)
+
+	fns := registeredFns{}
+	ctx = context.WithValue(ctx, registerFnsKey, fns)
+
 	if err = eval(ctx, code, builtins); err != nil {
-		log.Fatalf("eval: %s", err)
+		return fmt.Errorf("eval: %w", err)
+	}
+
+	// hashed once everything is evaluated so the globals they use are final
+	for target, fn := range fns {
+		if err := bs.SetFnHash(target, hashFn(fn)); err != nil {
+			return fmt.Errorf("hashing targets: %w", err)
+		}
 	}
+	return nil
+}
+
+func main() {
 
-	availableTargets := getAvailableTargets(bs)
+	bs := yabs.New()
+	// build.yb is evaluated once the flags are parsed, toolchains are put in
+	// the cache dir while it is. Only the commands that need its targets
+	// evaluate it, so the others work outside a project.
+	evaluated := false
+	evalOnce := func() error {
+		if evaluated {
+			return nil
+		}
+		evaluated = true
+		return evalBuildFile(bs)
+	}
+	evalBefore := func(cCtx *cli.Context) error {
+		return evalOnce()
+	}
 
-	cli.AppHelpTemplate = fmt.Sprintf(`NAME:
+	cli.AppHelpTemplate = `NAME:
    {{.Name}} - {{.Usage}}
 USAGE:
    {{.HelpName}} {{if .VisibleFlags}}[global options]{{end}}{{if .Commands}} command [command options]{{end}} {{if .ArgsUsage}}{{.ArgsUsage}}{{else}}[arguments...]{{end}}
-   {{.HelpName}} target
+   {{.HelpName}} [targets...]
    {{if len .Authors}}
 AUTHOR:
    {{range .Authors}}{{ . }}{{end}}
-   {{end}}{{if .Commands}}%s
+   {{end}}{{if .Commands}}{{targets}}
 COMMANDS:
 {{range .Commands}}{{if not .HideHelp}}   {{join .Names ", "}}{{ "\t"}}{{.Usage}}{{ "\n" }}{{end}}{{end}}{{end}}{{if .VisibleFlags}}
 GLOBAL OPTIONS:
@@ -75,20 +163,205 @@ COPYRIGHT:
 VERSION:
    {{.Version}}
    {{end}}
-`, availableTargets)
+`
+	printHelp := cli.HelpPrinterCustom
+	cli.HelpPrinter = func(w io.Writer, templ string, data interface{}) {
+		printHelp(w, templ, data, map[string]interface{}{
+			"targets": func() string {
+				// help outside a project has no targets to list
+				if err := evalOnce(); errors.Is(err, fs.ErrNotExist) {
+					return ""
+				} else if err != nil {
+					log.Fatal(err)
+				}
+				return getAvailableTargets(bs)
+			},
+		})
+	}
 
 	var profile bool
+	var keepGoing bool
+	var jobs int
+	var criticalPath bool
+	var dryRun bool
+	var explain bool
+	var remoteCache string
+	var remoteUpload bool
+	var remoteInstance string
+	var rehash bool
+	var noWait bool
 	app := &cli.App{
 		EnableBashCompletion: true,
 		Usage:                "yet another build system",
 		Copyright:            "Apache-2.0",
 		Commands: []*cli.Command{
 			{
-				Name:  "prune",
-				Usage: "removes un-used caches from `.yabs` directory",
+				Name:   "prune",
+				Usage:  "removes un-used caches from `.yabs` directory",
+				Before: evalBefore,
+				Action: func(cCtx *cli.Context) error {
+					bs.NoWait = noWait
+					return bs.Prune()
+				},
+			},
+			{
+				Name:      "explain",
+				Usage:     "shows why a target was run or skipped in the last build",
+				ArgsUsage: "target",
+				Before:    evalBefore,
+				Action: func(cCtx *cli.Context) error {
+					if cCtx.NArg() != 1 {
+						return fmt.Errorf("expected one target, got %d", cCtx.NArg())
+					}
+					explanations, err := bs.Explain(cCtx.Args().First())
+					if err != nil {
+						return err
+					}
+					printExplanations(explanations)
+					return nil
+				},
+			},
+			{
+				Name:  "cache",
+				Usage: "manages the cache",
+				Subcommands: []*cli.Command{
+					{
+						Name:  "gc",
+						Usage: "evicts the least recently used entries from the cache, defaulting to the limits set by cache_limit",
+						Flags: []cli.Flag{
+							&cli.StringFlag{
+								Name:  "max-size",
+								Usage: "size to shrink the cache to, e.g. 10G",
+							},
+							&cli.StringFlag{
+								Name:  "max-age",
+								Usage: "evict entries that haven't been used for longer, e.g. 14d",
+							},
+						},
+						// build.yb sets the default limits
+						Before: evalBefore,
+						Action: func(cCtx *cli.Context) error {
+							limits := bs.CacheLimits
+							if cCtx.IsSet("max-size") || cCtx.IsSet("max-age") {
+								var err error
+								if limits, err = cacheLimits(cCtx.String("max-size"), cCtx.String("max-age")); err != nil {
+									return err
+								}
+							}
+							if err := bs.RestoreTasks(); err != nil {
+								return err
+							}
+							stats, err := bs.GC(limits)
+							if err != nil {
+								return err
+							}
+							log.Printf("evicted %d outputs and %d actions, freed %s, cache is now %s",
+								stats.Outputs, stats.Actions, yabs.FormatSize(stats.Freed), yabs.FormatSize(stats.Size))
+							return nil
+						},
+					},
+					{
+						Name:  "stats",
+						Usage: "shows what's in the cache and the hit ratio of recent builds",
+						Flags: []cli.Flag{
+							&cli.IntFlag{
+								Name:  "builds",
+								Value: 10,
+								Usage: "number of recent builds to count hits and misses over",
+							},
+							&cli.IntFlag{
+								Name:  "top",
+								Value: 10,
+								Usage: "number of the biggest outputs to list",
+							},
+						},
+						Action: func(cCtx *cli.Context) error {
+							stats, err := bs.CacheStats(cCtx.Int("builds"), cCtx.Int("top"))
+							if err != nil {
+								return err
+							}
+							printCacheStats(stats)
+							return nil
+						},
+					},
+					{
+						Name:      "ls",
+						Usage:     "lists the outputs a target had in recent builds",
+						ArgsUsage: "target",
+						Action: func(cCtx *cli.Context) error {
+							if cCtx.NArg() != 1 {
+								return fmt.Errorf("expected one target, got %d", cCtx.NArg())
+							}
+							target := cCtx.Args().First()
+							builds, err := bs.TargetHistory(target)
+							if err != nil {
+								return err
+							}
+							printTargetHistory(target, builds)
+							return nil
+						},
+					},
+					{
+						Name:  "verify",
+						Usage: "re-hashes the cache to find corrupt outputs",
+						Flags: []cli.Flag{
+							&cli.BoolFlag{
+								Name:  "fix",
+								Usage: "remove corrupt entries so they're rebuilt",
+							},
+						},
+						Action: func(cCtx *cli.Context) error {
+							problems, err := bs.VerifyCache(cCtx.Bool("fix"))
+							if err != nil {
+								return err
+							}
+							for _, problem := range problems {
+								fmt.Println(problem)
+							}
+							switch {
+							case len(problems) == 0:
+								log.Printf("cache is intact")
+							case cCtx.Bool("fix"):
+								log.Printf("removed %d corrupt entries", len(problems))
+							default:
+								return fmt.Errorf("found %d corrupt entries, run with --fix to remove them", len(problems))
+							}
+							return nil
+						},
+					},
+					{
+						Name:  "serve",
+						Usage: "serves a cache directory as a remote cache, for --remote-cache",
+						Flags: []cli.Flag{
+							&cli.StringFlag{
+								Name:     "dir",
+								Usage:    "directory the cache is stored in",
+								Required: true,
+							},
+							&cli.StringFlag{
+								Name:  "addr",
+								Value: ":8080",
+								Usage: "address to listen on",
+							},
+						},
+						Action: func(cCtx *cli.Context) error {
+							addr := cCtx.String("addr")
+							log.Printf("serving cache %q on %s", cCtx.String("dir"), addr)
+							return http.ListenAndServe(addr, yabs.CacheHandler(yabs.NewDiskCache(cCtx.String("dir"))))
+						},
+					},
+				},
+			},
+			{
+				Name:      "validate",
+				Usage:     "checks the targets' dependency graph for problems, like cycles",
+				ArgsUsage: "[targets...]",
+				Before:    evalBefore,
 				Action: func(cCtx *cli.Context) error {
-					bs.RestoreTasks()
-					bs.Prune()
+					if err := bs.Validate(cCtx.Args().Slice()...); err != nil {
+						return err
+					}
+					log.Printf("no problems found")
 					return nil
 				},
 			},
@@ -100,11 +373,105 @@ VERSION:
 				Usage:       "profile usage to `yabs.prof`",
 				Destination: &profile,
 			},
+			&cli.BoolFlag{
+				Name:        "keep-going",
+				Aliases:     []string{"k"},
+				Value:       false,
+				Usage:       "keep building targets that don't depend on a failed target",
+				Destination: &keepGoing,
+			},
+			&cli.IntFlag{
+				Name:        "jobs",
+				Aliases:     []string{"j"},
+				EnvVars:     []string{"YABS_JOBS"},
+				Value:       runtime.NumCPU(),
+				Usage:       "number of targets to run at once",
+				Destination: &jobs,
+			},
+			&cli.BoolFlag{
+				Name:        "critical-path",
+				Value:       false,
+				Usage:       "print the estimated critical path after the build",
+				Destination: &criticalPath,
+			},
+			&cli.BoolFlag{
+				Name:        "dry-run",
+				Aliases:     []string{"n"},
+				Value:       false,
+				Usage:       "print the targets that would run and why, without running them",
+				Destination: &dryRun,
+			},
+			&cli.StringFlag{
+				Name:        "cache-dir",
+				EnvVars:     []string{"YABS_CACHE_DIR"},
+				Value:       bs.CacheDir,
+				Usage:       "where outputs and toolchains are cached, shared between projects",
+				Destination: &bs.CacheDir,
+			},
+			&cli.StringFlag{
+				Name:        "remote-cache",
+				EnvVars:     []string{"YABS_REMOTE_CACHE"},
+				Usage:       "`URL` of a cache server checked for targets missing from the cache dir, http(s):// for bazel-remote's HTTP protocol or grpc(s):// for the Remote Execution API",
+				Destination: &remoteCache,
+			},
+			&cli.StringFlag{
+				Name:        "remote-instance",
+				EnvVars:     []string{"YABS_REMOTE_INSTANCE"},
+				Usage:       "instance name sent to a grpc(s):// remote cache",
+				Destination: &remoteInstance,
+			},
+			&cli.BoolFlag{
+				Name:        "remote-upload",
+				EnvVars:     []string{"YABS_REMOTE_UPLOAD"},
+				Value:       false,
+				Usage:       "upload the outputs of targets built by this build, or restored from the cache dir, to the remote cache",
+				Destination: &remoteUpload,
+			},
+			&cli.BoolFlag{
+				Name:        "rehash",
+				EnvVars:     []string{"YABS_REHASH"},
+				Value:       false,
+				Usage:       "read every file of every output instead of trusting the digests of files that haven't changed",
+				Destination: &rehash,
+			},
+			&cli.BoolFlag{
+				Name:        "no-wait",
+				Value:       false,
+				Usage:       "fail instead of waiting when another yabs process is using the project",
+				Destination: &noWait,
+			},
+			&cli.BoolFlag{
+				Name:        "explain",
+				Value:       false,
+				Usage:       "log why each target is run or skipped",
+				Destination: &explain,
+			},
 		},
 		Action: func(cCtx *cli.Context) error {
-			target := "build"
+			if err := evalOnce(); err != nil {
+				return err
+			}
+			targets := []string{"build"}
 			if cCtx.NArg() > 0 {
-				target = cCtx.Args().Get(0)
+				targets = cCtx.Args().Slice()
+			}
+
+			if remoteCache != "" {
+				remote, err := yabs.NewRemoteCache(remoteCache, remoteInstance)
+				if err != nil {
+					return err
+				}
+				bs.Remote = remote
+				bs.RemoteUpload = remoteUpload
+			}
+
+			if dryRun {
+				plan, err := bs.DryRun(targets)
+				if err != nil {
+					return err
+				}
+				printPlan(plan)
+				return nil
 			}
 
 			if profile {
@@ -118,9 +485,33 @@ VERSION:
 				defer pprof.StopCPUProfile()
 			}
 
-			return bs.ExecWithDefault(target)
+			if jobs < 1 {
+				return fmt.Errorf("jobs must be at least 1, got %d", jobs)
+			}
+			bs.KeepGoing = keepGoing
+			bs.Jobs = jobs
+			bs.LogReasons = explain
+			bs.Rehash = rehash
+			bs.NoWait = noWait
+
+			ctx, stop := signal.NotifyContext(cCtx.Context, os.Interrupt, syscall.SIGTERM)
+			defer stop()
+			go func() {
+				// a second signal kills yabs without waiting for targets to stop
+				<-ctx.Done()
+				stop()
+			}()
+
+			err := bs.ExecTargetsContext(ctx, targets)
+			if criticalPath {
+				printCriticalPath(bs, targets)
+			}
+			return err
 		},
 		BashComplete: func(ctx *cli.Context) {
+			if err := evalOnce(); err != nil {
+				return
+			}
 			for _, task := range bs.GetTaskNames() {
 				fmt.Println(task)
 			}
@@ -14,6 +14,22 @@ func validateString(obj object.Object) (string, error) {
 	return strObj.String(), nil
 }
 
+func validateInt(obj object.Object) (int64, error) {
+	intObj, ok := obj.(*object.Int)
+	if !ok {
+		return 0, fmt.Errorf("expected int, got=%T", obj)
+	}
+	return intObj.Value(), nil
+}
+
+func validateBool(obj object.Object) (bool, error) {
+	boolObj, ok := obj.(*object.Bool)
+	if !ok {
+		return false, fmt.Errorf("expected bool, got=%T", obj)
+	}
+	return boolObj.Value(), nil
+}
+
 type ValidateListOf interface {
 	~string
 }
@@ -0,0 +1,113 @@
+package yabs
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+
+	"golang.org/x/exp/slices"
+)
+
+// ErrDepFailed is the error recorded for a target that was skipped because
+// one of its dependencies failed
+var ErrDepFailed = errors.New("dependency failed")
+
+// ErrBuildStopped is the error recorded for a target that was skipped because
+// another target failed before it could start
+var ErrBuildStopped = errors.New("build stopped after an earlier failure")
+
+// TargetError is the error returned by a single target
+type TargetError struct {
+	Target string
+	Err    error
+}
+
+func (e *TargetError) Error() string {
+	return fmt.Sprintf("%q: %s", e.Target, e.Err)
+}
+
+func (e *TargetError) Unwrap() error {
+	return e.Err
+}
+
+// BuildError is returned when one or more targets in a build failed
+type BuildError struct {
+	// Failed are the targets whose task returned an error
+	Failed []*TargetError
+	// Skipped are the names of the targets that never ran because of a failure
+	Skipped []string
+}
+
+func (e *BuildError) Error() string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "%d target(s) failed", len(e.Failed))
+	for _, f := range e.Failed {
+		sb.WriteString("\n\t")
+		sb.WriteString(f.Error())
+	}
+	if len(e.Skipped) > 0 {
+		fmt.Fprintf(&sb, "\nskipped: %s", strings.Join(e.Skipped, ", "))
+	}
+	return sb.String()
+}
+
+func isSkipped(err error) bool {
+	return errors.Is(err, ErrDepFailed) || errors.Is(err, ErrBuildStopped)
+}
+
+// buildError collects the errors of the finished tasks, nil if none failed
+func (y *Yabs) buildError() error {
+	buildErr := &BuildError{}
+	for name, task := range y.taskKV {
+		if task.Err == nil {
+			continue
+		}
+		if isSkipped(task.Err) {
+			buildErr.Skipped = append(buildErr.Skipped, name)
+		} else {
+			buildErr.Failed = append(buildErr.Failed, &TargetError{Target: name, Err: task.Err})
+		}
+	}
+	if len(buildErr.Failed) == 0 && len(buildErr.Skipped) == 0 {
+		return nil
+	}
+
+	slices.Sort(buildErr.Skipped)
+	slices.SortFunc(buildErr.Failed, func(a, b *TargetError) int {
+		return strings.Compare(a.Target, b.Target)
+	})
+	return buildErr
+}
+
+// printSummary logs which of the scheduled targets succeeded, failed or were
+// skipped
+func (y *Yabs) printSummary() {
+	succeeded, failed, skipped := []string{}, []string{}, []string{}
+	for name, task := range y.taskKV {
+		if !y.scheduler.taskDone[name] {
+			continue
+		}
+		switch {
+		case task.Err == nil:
+			succeeded = append(succeeded, name)
+		case isSkipped(task.Err):
+			skipped = append(skipped, name)
+		default:
+			failed = append(failed, name)
+		}
+	}
+	slices.Sort(succeeded)
+	slices.Sort(failed)
+	slices.Sort(skipped)
+
+	log.Printf("summary: %d succeeded, %d failed, %d skipped", len(succeeded), len(failed), len(skipped))
+	for _, group := range []struct {
+		label   string
+		targets []string
+	}{{"succeeded", succeeded}, {"failed", failed}, {"skipped", skipped}} {
+		if len(group.targets) > 0 {
+			log.Printf("\t%s: %s", group.label, strings.Join(group.targets, ", "))
+		}
+	}
+}
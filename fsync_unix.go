@@ -0,0 +1,16 @@
+//go:build !windows
+
+package yabs
+
+import "os"
+
+// syncDir flushes a directory's entries to disk, so a file renamed into it
+// survives a crash
+func syncDir(dir string) error {
+	f, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return f.Sync()
+}
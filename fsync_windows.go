@@ -0,0 +1,8 @@
+//go:build windows
+
+package yabs
+
+// syncDir does nothing, directories can't be opened for syncing on windows
+func syncDir(dir string) error {
+	return nil
+}
@@ -0,0 +1,325 @@
+package yabs
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// CacheLimits bounds the size of the cache, entries that were used least
+// recently are evicted first. A zero field is no limit.
+type CacheLimits struct {
+	// MaxSize is the size in bytes the cache is shrunk to
+	MaxSize int64
+	// MaxAge evicts entries that haven't been used for longer
+	MaxAge time.Duration
+}
+
+func (l CacheLimits) IsZero() bool {
+	return l.MaxSize <= 0 && l.MaxAge <= 0
+}
+
+// GCStats is what was removed by a GC
+type GCStats struct {
+	// Outputs is the number of outputs evicted
+	Outputs int
+	// Actions is the number of action results evicted
+	Actions int
+	// Freed is the number of bytes removed
+	Freed int64
+	// Size is the size of the cache afterwards
+	Size int64
+}
+
+// cacheLock is held shared by builds and exclusively by GC, so entries aren't
+// removed while a build might use them
+func (y *Yabs) cacheLock() (*FileLock, error) {
+	return OpenLock(filepath.Join(y.CacheDir, "lock"))
+}
+
+// touch marks a cache entry as used now, entries' modification times are used
+// as their access times since filesystems are often mounted with noatime
+func touch(loc string) {
+	now := time.Now()
+	_ = os.Chtimes(loc, now, now)
+}
+
+// GC evicts entries from the cache until it's within limits, waiting for
+// running builds to finish first. Outputs and actions referenced by the latest
+// records of any project using the cache, or by the current targets, are
+// never evicted. Blobs that no output refers to, actions whose output is gone
+// and leftover temp files are always removed.
+func (y *Yabs) GC(limits CacheLimits) (GCStats, error) {
+	lk, err := y.cacheLock()
+	if err != nil {
+		return GCStats{}, err
+	}
+	if err := lk.Lock(); err != nil {
+		return GCStats{}, err
+	}
+	defer lk.Unlock()
+	return y.gc(limits)
+}
+
+// autoGC applies CacheLimits after a build, it's skipped if another build is
+// using the cache
+func (y *Yabs) autoGC() {
+	if y.CacheLimits.IsZero() {
+		return
+	}
+	lk, err := y.cacheLock()
+	if err != nil {
+		log.Printf("cache gc: %s", err)
+		return
+	}
+	ok, err := lk.TryLock()
+	if err != nil || !ok {
+		if err != nil {
+			log.Printf("cache gc: %s", err)
+		}
+		_ = lk.Unlock()
+		return
+	}
+	defer lk.Unlock()
+	stats, err := y.gc(y.CacheLimits)
+	if err != nil {
+		log.Printf("cache gc: %s", err)
+		return
+	}
+	if stats.Outputs > 0 || stats.Actions > 0 {
+		log.Printf("cache gc: evicted %d outputs and %d actions, freed %s", stats.Outputs, stats.Actions, FormatSize(stats.Freed))
+	}
+}
+
+// cacheFile is a file in one of the cache's dirs, named by its digest
+type cacheFile struct {
+	digest string
+	loc    string
+	size   int64
+	used   time.Time
+}
+
+// listCache lists the files in one of the cache's dirs, removing leftover temp
+// files
+func (y *Yabs) listCache(dir string) ([]cacheFile, error) {
+	files := []cacheFile{}
+	root := filepath.Join(y.CacheDir, dir)
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		if strings.HasPrefix(d.Name(), ".tmp-") {
+			return os.Remove(path)
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		files = append(files, cacheFile{
+			digest: strings.ReplaceAll(filepath.ToSlash(rel), "/", ""),
+			loc:    path,
+			size:   info.Size(),
+			used:   info.ModTime(),
+		})
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("listing %s: %w", dir, err)
+	}
+	return files, nil
+}
+
+// inUse is the outputs and actions referenced by the latest records of every
+// project using the cache, and by the current targets
+func (y *Yabs) inUse() (checksums, keys map[string]bool, err error) {
+	checksums, keys = map[string]bool{}, map[string]bool{}
+	roots, err := y.readRoots()
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, r := range roots {
+		for _, checksum := range r.Checksums {
+			checksums[checksum] = true
+		}
+		for _, key := range r.Keys {
+			keys[key] = true
+		}
+	}
+	for _, rec := range y.records {
+		checksums[rec.Checksum] = true
+		keys[rec.Key] = true
+	}
+	for _, t := range y.taskKV {
+		checksums[t.Checksum] = true
+		keys[t.Key] = true
+	}
+	return checksums, keys, nil
+}
+
+func (y *Yabs) gc(limits CacheLimits) (GCStats, error) {
+	stats := GCStats{}
+	now := time.Now()
+	expired := func(f cacheFile) bool {
+		return limits.MaxAge > 0 && now.Sub(f.used) > limits.MaxAge
+	}
+	overSize := func() bool {
+		return limits.MaxSize > 0 && stats.Size > limits.MaxSize
+	}
+	checksums, keys, err := y.inUse()
+	if err != nil {
+		return stats, err
+	}
+
+	trees, err := y.listCache("trees")
+	if err != nil {
+		return stats, err
+	}
+	blobList, err := y.listCache("blobs")
+	if err != nil {
+		return stats, err
+	}
+	actions, err := y.listCache("actions")
+	if err != nil {
+		return stats, err
+	}
+
+	blobs := map[string]cacheFile{}
+	for _, f := range blobList {
+		blobs[f.digest] = f
+		stats.Size += f.size
+	}
+	for _, f := range trees {
+		stats.Size += f.size
+	}
+	for _, f := range actions {
+		stats.Size += f.size
+	}
+
+	remove := func(f cacheFile) error {
+		if err := os.Remove(f.loc); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		stats.Size -= f.size
+		stats.Freed += f.size
+		return nil
+	}
+
+	// blobs are removed once no output refers to them
+	refs := map[string]int{}
+	treeBlobs := map[string][]string{}
+	corrupt := map[string]bool{}
+	for _, f := range trees {
+		tr, err := y.readTree(f.digest)
+		if err != nil {
+			corrupt[f.digest] = true
+			continue
+		}
+		seen := map[string]bool{}
+		for _, entry := range tr.Entries {
+			if entry.Digest != "" && !seen[entry.Digest] {
+				seen[entry.Digest] = true
+				refs[entry.Digest]++
+				treeBlobs[f.digest] = append(treeBlobs[f.digest], entry.Digest)
+			}
+		}
+	}
+	for digest, f := range blobs {
+		if refs[digest] == 0 {
+			if err := remove(f); err != nil {
+				return stats, err
+			}
+		}
+	}
+
+	// least recently used first
+	sort.Slice(trees, func(i, j int) bool { return trees[i].used.Before(trees[j].used) })
+	for _, f := range trees {
+		if checksums[f.digest] {
+			continue
+		}
+		if !corrupt[f.digest] && !expired(f) && !overSize() {
+			continue
+		}
+		if err := remove(f); err != nil {
+			return stats, err
+		}
+		stats.Outputs++
+		for _, digest := range treeBlobs[f.digest] {
+			refs[digest]--
+			if blob, ok := blobs[digest]; ok && refs[digest] == 0 {
+				if err := remove(blob); err != nil {
+					return stats, err
+				}
+			}
+		}
+		if err := y.removeOut(f.digest); err != nil {
+			return stats, err
+		}
+	}
+
+	sort.Slice(actions, func(i, j int) bool { return actions[i].used.Before(actions[j].used) })
+	for _, f := range actions {
+		if keys[f.digest] {
+			continue
+		}
+		res := actionResult{}
+		bs, err := os.ReadFile(f.loc)
+		dangling := err != nil || json.Unmarshal(bs, &res) != nil
+		if res.Checksum != "" {
+			if _, err := os.Stat(y.getCacheLoc(res.Checksum)); err != nil {
+				dangling = true
+			}
+		}
+		if !dangling && !expired(f) && !overSize() {
+			continue
+		}
+		if err := remove(f); err != nil {
+			return stats, err
+		}
+		stats.Actions++
+	}
+	return stats, nil
+}
+
+// removeOut removes this project's materialised copy of an evicted output, its
+// hardlinks would keep the blobs' space from being freed
+func (y *Yabs) removeOut(checksum string) error {
+	out, err := y.getOutLoc(checksum)
+	if err != nil {
+		return err
+	}
+	if _, err := os.Lstat(out); err != nil {
+		return nil
+	}
+	return removeDir(out)
+}
+
+// FormatSize formats a number of bytes for people, e.g. 1.5G
+func FormatSize(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%dB", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f%c", float64(n)/float64(div), "KMGTPE"[exp])
+}
@@ -0,0 +1,177 @@
+package yabs
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestGC(t *testing.T) {
+	chdirTemp(t)
+
+	runs := map[string]int{}
+	project := func(targets ...string) *Yabs {
+		y := New()
+		for _, target := range targets {
+			target := target
+			y.Register(target, []string{}, func(bc BuildCtx) error {
+				runs[target]++
+				return os.WriteFile(bc.Out, []byte("out of "+target), 0o644)
+			})
+		}
+		y.Register("default", targets, func(bc BuildCtx) error { return nil }, WithAlwaysRun())
+		if err := y.ExecWithDefault("default"); err != nil {
+			t.Fatal(err)
+		}
+		return y
+	}
+
+	project("old", "kept")
+	y := project("kept")
+	stats, err := y.GC(CacheLimits{MaxSize: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Outputs != 1 {
+		t.Fatalf("want only \"old\"'s output to be evicted, evicted %d outputs", stats.Outputs)
+	}
+
+	project("old", "kept")
+	if runs["old"] != 2 {
+		t.Fatalf("want evicted \"old\" to run again, ran %d times", runs["old"])
+	}
+	if runs["kept"] != 1 {
+		t.Fatalf("want \"kept\" to be restored, ran %d times", runs["kept"])
+	}
+}
+
+func TestGCKeepsOtherProjectsOutputs(t *testing.T) {
+	chdirTemp(t)
+
+	build := func(dir string) *Yabs {
+		if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chdir(dir); err != nil {
+			t.Fatal(err)
+		}
+		defer os.Chdir("..")
+		y := New()
+		y.Register(dir, []string{}, func(bc BuildCtx) error {
+			return os.WriteFile(bc.Out, []byte("out of "+dir), 0o644)
+		})
+		if err := y.ExecWithDefault(dir); err != nil {
+			t.Fatal(err)
+		}
+		return y
+	}
+
+	other := build("other")
+	y := build("project")
+	stats, err := y.GC(CacheLimits{MaxSize: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Outputs != 0 {
+		t.Fatalf("want the other project's output kept, evicted %d outputs", stats.Outputs)
+	}
+	if _, err := os.Stat(y.getCacheLoc(other.taskKV["other"].Checksum)); err != nil {
+		t.Fatal("want the other project's output still in the cache")
+	}
+
+	// a removed project's root is dropped
+	if err := os.RemoveAll("other"); err != nil {
+		t.Fatal(err)
+	}
+	stats, err = y.GC(CacheLimits{MaxSize: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Outputs != 1 {
+		t.Fatalf("want the removed project's output evicted, evicted %d outputs", stats.Outputs)
+	}
+}
+
+func TestGCMaxAge(t *testing.T) {
+	chdirTemp(t)
+
+	build := func(target string) *Yabs {
+		y := New()
+		y.Register(target, []string{}, func(bc BuildCtx) error {
+			return os.WriteFile(bc.Out, []byte("out of "+target), 0o644)
+		})
+		if err := y.ExecWithDefault(target); err != nil {
+			t.Fatal(err)
+		}
+		return y
+	}
+
+	old := build("old")
+	oldTree := old.getCacheLoc(old.taskKV["old"].Checksum)
+	recent := build("recent")
+	recentTree := recent.getCacheLoc(recent.taskKV["recent"].Checksum)
+
+	past := time.Now().Add(-48 * time.Hour)
+	if err := os.Chtimes(oldTree, past, past); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := New().GC(CacheLimits{MaxAge: 24 * time.Hour}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(oldTree); err == nil {
+		t.Fatal("want the output unused for 48h to be evicted")
+	}
+	if _, err := os.Stat(recentTree); err != nil {
+		t.Fatalf("want the recently used output to be kept: %s", err)
+	}
+	blobs, err := filepath.Glob(filepath.Join("cache", "blobs", "*", "*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(blobs) != 1 {
+		t.Fatalf("want the evicted output's blob removed, got %d blobs", len(blobs))
+	}
+}
+
+func TestAutoGCSkippedWhileCacheInUse(t *testing.T) {
+	chdirTemp(t)
+
+	build := func(target string) *Yabs {
+		y := New()
+		y.Register(target, []string{}, func(bc BuildCtx) error {
+			return os.WriteFile(bc.Out, []byte("out of "+target), 0o644)
+		})
+		if err := y.ExecWithDefault(target); err != nil {
+			t.Fatal(err)
+		}
+		return y
+	}
+	// an output the project's latest records no longer refer to
+	y := build("old")
+	tree := y.getCacheLoc(y.taskKV["old"].Checksum)
+	build("new")
+
+	other, err := y.cacheLock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := other.RLock(); err != nil {
+		t.Fatal(err)
+	}
+	gc := New()
+	gc.CacheLimits = CacheLimits{MaxSize: 1}
+	gc.autoGC()
+	if _, err := os.Stat(tree); err != nil {
+		t.Fatalf("want nothing evicted while another build uses the cache: %s", err)
+	}
+
+	if err := other.Unlock(); err != nil {
+		t.Fatal(err)
+	}
+	gc.autoGC()
+	if _, err := os.Stat(tree); err == nil {
+		t.Fatal("want the output evicted once the cache is free")
+	}
+}
@@ -0,0 +1,240 @@
+package yabs
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"golang.org/x/exp/slices"
+)
+
+// CycleError is returned when targets depend on each other in a loop, which
+// would otherwise never finish scheduling
+type CycleError struct {
+	// Path starts and ends with the same target
+	Path []string
+}
+
+func (e *CycleError) Error() string {
+	return fmt.Sprintf("cycle: %s", strings.Join(e.Path, " -> "))
+}
+
+// UnknownDepError is returned when a target depends on a target that was
+// never registered
+type UnknownDepError struct {
+	Target string
+	Dep    string
+	// Loc is where Target was registered, if known
+	Loc string
+	// Suggestion is the closest registered target name, if any is close enough
+	Suggestion string
+}
+
+func (e *UnknownDepError) Error() string {
+	var sb strings.Builder
+	if e.Loc != "" {
+		sb.WriteString(e.Loc)
+		sb.WriteString(": ")
+	}
+	fmt.Fprintf(&sb, "target %q depends on unknown target %q", e.Target, e.Dep)
+	if e.Suggestion != "" {
+		fmt.Fprintf(&sb, ", did you mean %q?", e.Suggestion)
+	}
+	return sb.String()
+}
+
+// Validate checks the dependency graph of the given targets, or every
+// registered target if none are given, before anything gets scheduled
+func (y *Yabs) Validate(targets ...string) error {
+	if len(targets) == 0 {
+		targets = y.GetTaskNames()
+		slices.Sort(targets)
+	}
+
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+	state := map[string]int{}
+	path := []string{}
+	unknown := []error{}
+
+	var visit func(name string) error
+	visit = func(name string) error {
+		task := y.taskKV[name]
+		switch state[name] {
+		case visited:
+			return nil
+		case visiting:
+			start := slices.Index(path, name)
+			cycle := append(slices.Clone(path[start:]), name)
+			return &CycleError{Path: cycle}
+		}
+
+		state[name] = visiting
+		path = append(path, name)
+		for _, dep := range task.Dep {
+			if _, ok := y.taskKV[dep]; !ok {
+				unknown = append(unknown, &UnknownDepError{
+					Target:     name,
+					Dep:        dep,
+					Loc:        task.Loc,
+					Suggestion: suggest(dep, y.GetTaskNames()),
+				})
+				continue
+			}
+			if err := visit(dep); err != nil {
+				return err
+			}
+		}
+		path = path[:len(path)-1]
+		state[name] = visited
+		return nil
+	}
+
+	for _, target := range targets {
+		if _, ok := y.taskKV[target]; !ok {
+			return fmt.Errorf("%q task not found", target)
+		}
+		if err := visit(target); err != nil {
+			return err
+		}
+	}
+	return errors.Join(unknown...)
+}
+
+// suggest returns the candidate closest to name, or "" if none are close
+// enough to be a likely typo
+func suggest(name string, candidates []string) string {
+	slices.Sort(candidates)
+	best, bestDist := "", len(name)/3+2
+	for _, candidate := range candidates {
+		if dist := editDistance(name, candidate); dist < bestDist {
+			best, bestDist = candidate, dist
+		}
+	}
+	return best
+}
+
+// editDistance is the levenshtein distance between a and b
+func editDistance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	curr := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		curr[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			curr[j] = prev[j-1] + cost
+			if prev[j]+1 < curr[j] {
+				curr[j] = prev[j] + 1
+			}
+			if curr[j-1]+1 < curr[j] {
+				curr[j] = curr[j-1] + 1
+			}
+		}
+		prev, curr = curr, prev
+	}
+	return prev[len(b)]
+}
+
+// prioritize sets the priority of every task needed to build the targets to
+// the longest estimated path from the start of the task to the end of the
+// build, using the durations recorded from previous runs
+func (y *Yabs) prioritize(targets ...string) {
+	dependents := map[string][]string{}
+	seen := map[string]bool{}
+	var collect func(name string)
+	collect = func(name string) {
+		if seen[name] {
+			return
+		}
+		seen[name] = true
+		for _, dep := range y.taskKV[name].Dep {
+			dependents[dep] = append(dependents[dep], name)
+			collect(dep)
+		}
+	}
+	for _, target := range targets {
+		collect(target)
+	}
+
+	done := map[string]bool{}
+	var visit func(name string) time.Duration
+	visit = func(name string) time.Duration {
+		task := y.taskKV[name]
+		if done[name] {
+			return task.priority
+		}
+		var rest time.Duration
+		for _, dependent := range dependents[name] {
+			if p := visit(dependent); p > rest {
+				rest = p
+			}
+		}
+		task.priority = task.Duration + rest
+		done[name] = true
+		return task.priority
+	}
+	for name := range seen {
+		visit(name)
+	}
+}
+
+// PathStep is a target on the critical path and its recorded duration
+type PathStep struct {
+	Target   string
+	Duration time.Duration
+}
+
+// CriticalPath is the chain of dependencies of the targets that takes the
+// longest to run based on recorded durations, ordered from the first target to run
+func (y *Yabs) CriticalPath(targets ...string) []PathStep {
+	longest := map[string]time.Duration{}
+	next := map[string]string{}
+	var visit func(name string) time.Duration
+	visit = func(name string) time.Duration {
+		if d, ok := longest[name]; ok {
+			return d
+		}
+		task := y.taskKV[name]
+		var rest time.Duration
+		for _, dep := range task.Dep {
+			if _, ok := y.taskKV[dep]; !ok {
+				continue
+			}
+			if d := visit(dep); d > rest || next[name] == "" {
+				rest = d
+				next[name] = dep
+			}
+		}
+		longest[name] = task.Duration + rest
+		return longest[name]
+	}
+	start := ""
+	for _, target := range targets {
+		if _, ok := y.taskKV[target]; !ok {
+			continue
+		}
+		if d := visit(target); start == "" || d > longest[start] {
+			start = target
+		}
+	}
+	if start == "" {
+		return nil
+	}
+
+	path := []PathStep{}
+	for name := start; name != ""; name = next[name] {
+		path = append(path, PathStep{Target: name, Duration: y.taskKV[name].Duration})
+	}
+	slices.Reverse(path)
+	return path
+}
@@ -0,0 +1,129 @@
+package yabs
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"golang.org/x/exp/slices"
+)
+
+func noop(bc BuildCtx) error { return nil }
+
+func TestValidateCycles(t *testing.T) {
+	tests := []struct {
+		name   string
+		input  func(*Yabs)
+		target string
+		cycle  []string
+	}{
+		{
+			name:   "no cycle",
+			target: "a",
+			input: func(y *Yabs) {
+				y.Register("a", []string{"b", "c"}, noop)
+				y.Register("b", []string{"c"}, noop)
+				y.Register("c", []string{}, noop)
+			},
+		},
+		{
+			name:   "self cycle",
+			target: "a",
+			input: func(y *Yabs) {
+				y.Register("a", []string{"a"}, noop)
+			},
+			cycle: []string{"a", "a"},
+		},
+		{
+			name:   "indirect cycle",
+			target: "release",
+			input: func(y *Yabs) {
+				y.Register("release", []string{"yabs_linux_amd64"}, noop)
+				y.Register("yabs_linux_amd64", []string{"go_download"}, noop)
+				y.Register("go_download", []string{"release"}, noop)
+			},
+			cycle: []string{"release", "yabs_linux_amd64", "go_download", "release"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			y := New()
+			tt.input(y)
+
+			err := y.Validate(tt.target)
+			var cycleErr *CycleError
+			if tt.cycle == nil {
+				if err != nil {
+					t.Fatalf("want no error, got=%s", err)
+				}
+				return
+			}
+			if !errors.As(err, &cycleErr) {
+				t.Fatalf("want *CycleError, got=%v", err)
+			}
+			if slices.Compare(cycleErr.Path, tt.cycle) != 0 {
+				t.Fatalf("want cycle=%v, got=%v", tt.cycle, cycleErr.Path)
+			}
+		})
+	}
+}
+
+func TestValidateUnknownDeps(t *testing.T) {
+	y := New()
+	y.Register("go_download", []string{}, noop)
+	y.Register("build", []string{"go_dowload"}, noop, WithLocation("build.yb:3"))
+
+	err := y.Validate("build")
+
+	var depErr *UnknownDepError
+	if !errors.As(err, &depErr) {
+		t.Fatalf("want *UnknownDepError, got=%v", err)
+	}
+	want := UnknownDepError{Target: "build", Dep: "go_dowload", Loc: "build.yb:3", Suggestion: "go_download"}
+	if *depErr != want {
+		t.Fatalf("want %+v, got=%+v", want, *depErr)
+	}
+}
+
+func TestSuggest(t *testing.T) {
+	candidates := []string{"go_download", "golangci-lint", "lint", "test"}
+	for name, want := range map[string]string{
+		"go_dowload": "go_download",
+		"lnit":       "lint",
+		"tset":       "test",
+		"release":    "",
+	} {
+		if got := suggest(name, candidates); got != want {
+			t.Errorf("suggest(%q) want=%q, got=%q", name, want, got)
+		}
+	}
+}
+
+func TestPrioritizeAndCriticalPath(t *testing.T) {
+	y := New()
+	y.Register("go_download", []string{}, noop)
+	y.Register("build", []string{"go_download"}, noop)
+	y.Register("archive", []string{"build"}, noop)
+	y.Register("docs", []string{}, noop)
+	y.Register("release", []string{"archive", "docs"}, noop)
+	for name, d := range map[string]time.Duration{"go_download": 3, "build": 20, "archive": 1, "docs": 10, "release": 2} {
+		y.taskKV[name].Duration = d
+	}
+
+	y.prioritize("release")
+
+	for name, want := range map[string]time.Duration{"go_download": 26, "build": 23, "archive": 3, "docs": 12, "release": 2} {
+		if got := y.taskKV[name].priority; got != want {
+			t.Errorf("%q want priority=%d, got=%d", name, want, got)
+		}
+	}
+
+	path := []string{}
+	for _, step := range y.CriticalPath("release") {
+		path = append(path, step.Target)
+	}
+	if want := []string{"go_download", "build", "archive", "release"}; slices.Compare(path, want) != 0 {
+		t.Fatalf("want critical path=%v, got=%v", want, path)
+	}
+}
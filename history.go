@@ -0,0 +1,114 @@
+package yabs
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"golang.org/x/exp/slices"
+)
+
+// maxHistory is how many builds are kept in the history
+const maxHistory = 100
+
+// BuildRecord summarises a build, the last builds are kept for cache stats
+type BuildRecord struct {
+	Time    time.Time
+	Targets []string
+	Tasks   []BuildTask
+}
+
+// BuildTask is a task that finished in a build
+type BuildTask struct {
+	Name     string
+	Checksum string `json:",omitempty"`
+	Key      string `json:",omitempty"`
+	Reason   Reason
+	Duration time.Duration `json:",omitempty"`
+	Failed   bool          `json:",omitempty"`
+}
+
+// Hit reports whether the task was restored from the cache instead of run
+func (t BuildTask) Hit() bool {
+	return !t.Failed && !t.Reason.Dirty()
+}
+
+// Miss reports whether the task ran because it wasn't cached, tasks that
+// always run aren't misses
+func (t BuildTask) Miss() bool {
+	return !t.Failed && t.Reason.Dirty() && t.Reason.Kind != AlwaysRuns
+}
+
+func (y *Yabs) historyLoc() string {
+	return filepath.Join(y.tmpDir, "history.jsonl")
+}
+
+// History returns the last builds, oldest first
+func (y *Yabs) History() ([]BuildRecord, error) {
+	f, err := os.Open(y.historyLoc())
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("reading history: %w", err)
+	}
+	defer f.Close()
+
+	builds := []BuildRecord{}
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 64<<20)
+	for scanner.Scan() {
+		build := BuildRecord{}
+		// a line cut short by a crash is skipped
+		if err := json.Unmarshal(scanner.Bytes(), &build); err != nil {
+			continue
+		}
+		builds = append(builds, build)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("reading history: %w", err)
+	}
+	return builds, nil
+}
+
+// saveHistory adds this build to the history, dropping the oldest builds
+func (y *Yabs) saveHistory(start time.Time, targets []string) error {
+	builds, err := y.History()
+	if err != nil {
+		return err
+	}
+	build := BuildRecord{Time: start, Targets: targets}
+	for name, task := range y.taskKV {
+		if !y.scheduler.taskDone[name] {
+			continue
+		}
+		build.Tasks = append(build.Tasks, BuildTask{
+			Name:     name,
+			Checksum: task.Checksum,
+			Key:      task.Key,
+			Reason:   task.Reason,
+			Duration: task.Duration,
+			Failed:   task.Err != nil,
+		})
+	}
+	slices.SortFunc(build.Tasks, func(a, b BuildTask) int { return strings.Compare(a.Name, b.Name) })
+	builds = append(builds, build)
+	if len(builds) > maxHistory {
+		builds = builds[len(builds)-maxHistory:]
+	}
+	return writeAtomic(y.historyLoc(), 0o644, func(w io.Writer) error {
+		enc := json.NewEncoder(w)
+		for _, build := range builds {
+			if err := enc.Encode(build); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
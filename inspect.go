@@ -0,0 +1,335 @@
+package yabs
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"time"
+)
+
+// CacheStats describes what's in the cache and how well it's been used
+type CacheStats struct {
+	Actions int
+	Outputs int
+	Blobs   int
+	// Size is the number of bytes the cache takes up
+	Size int64
+	// Builds is the number of recent builds Hits and Misses are counted over
+	Builds int
+	Hits   int
+	Misses int
+	// Biggest are the biggest outputs in the cache, biggest first
+	Biggest []CacheEntry
+}
+
+// HitRatio is the fraction of tasks that were restored from the cache
+func (s CacheStats) HitRatio() float64 {
+	if s.Hits+s.Misses == 0 {
+		return 0
+	}
+	return float64(s.Hits) / float64(s.Hits+s.Misses)
+}
+
+// CacheEntry is an output in the cache
+type CacheEntry struct {
+	Checksum string
+	// Targets are the targets known to have had the output, from this
+	// project's history
+	Targets []string
+	// Size is the size of the output's blobs, blobs shared with other outputs
+	// are counted for each of them
+	Size     int64
+	LastUsed time.Time
+}
+
+// CacheStats summarises the cache, counting hits and misses over the last
+// builds and listing the top biggest outputs
+func (y *Yabs) CacheStats(builds, top int) (CacheStats, error) {
+	stats := CacheStats{}
+	trees, err := y.listCache("trees")
+	if err != nil {
+		return stats, err
+	}
+	blobList, err := y.listCache("blobs")
+	if err != nil {
+		return stats, err
+	}
+	actions, err := y.listCache("actions")
+	if err != nil {
+		return stats, err
+	}
+	stats.Outputs, stats.Blobs, stats.Actions = len(trees), len(blobList), len(actions)
+	blobs := map[string]int64{}
+	for _, f := range blobList {
+		blobs[f.digest] = f.size
+		stats.Size += f.size
+	}
+	for _, f := range trees {
+		stats.Size += f.size
+	}
+	for _, f := range actions {
+		stats.Size += f.size
+	}
+
+	history, err := y.History()
+	if err != nil {
+		return stats, err
+	}
+	targets := map[string][]string{}
+	for _, build := range history {
+		for _, task := range build.Tasks {
+			if task.Checksum != "" && !contains(targets[task.Checksum], task.Name) {
+				targets[task.Checksum] = append(targets[task.Checksum], task.Name)
+			}
+		}
+	}
+	if builds > len(history) {
+		builds = len(history)
+	}
+	stats.Builds = builds
+	for _, build := range history[len(history)-builds:] {
+		for _, task := range build.Tasks {
+			switch {
+			case task.Hit():
+				stats.Hits++
+			case task.Miss():
+				stats.Misses++
+			}
+		}
+	}
+
+	for _, f := range trees {
+		entry := CacheEntry{Checksum: f.digest, Targets: targets[f.digest], Size: f.size, LastUsed: f.used}
+		if tr, err := y.readTree(f.digest); err == nil {
+			for _, digest := range treeDigests(tr) {
+				entry.Size += blobs[digest]
+			}
+		}
+		stats.Biggest = append(stats.Biggest, entry)
+	}
+	sort.Slice(stats.Biggest, func(i, j int) bool { return stats.Biggest[i].Size > stats.Biggest[j].Size })
+	if len(stats.Biggest) > top {
+		stats.Biggest = stats.Biggest[:top]
+	}
+	return stats, nil
+}
+
+func contains(names []string, name string) bool {
+	for _, n := range names {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+// treeDigests are the unique blobs a tree refers to
+func treeDigests(tr tree) []string {
+	digests := []string{}
+	seen := map[string]bool{}
+	for _, entry := range tr.Entries {
+		if entry.Digest != "" && !seen[entry.Digest] {
+			seen[entry.Digest] = true
+			digests = append(digests, entry.Digest)
+		}
+	}
+	return digests
+}
+
+// TargetBuild is a target's result in a past build
+type TargetBuild struct {
+	Time     time.Time
+	Checksum string
+	Key      string
+	Reason   Reason
+	Failed   bool
+	// Cached is whether the output is still in the cache
+	Cached bool
+}
+
+// TargetHistory is the target's results in the builds it was part of, oldest
+// first
+func (y *Yabs) TargetHistory(target string) ([]TargetBuild, error) {
+	history, err := y.History()
+	if err != nil {
+		return nil, err
+	}
+	results := []TargetBuild{}
+	for _, build := range history {
+		for _, task := range build.Tasks {
+			if task.Name != target {
+				continue
+			}
+			result := TargetBuild{
+				Time:     build.Time,
+				Checksum: task.Checksum,
+				Key:      task.Key,
+				Reason:   task.Reason,
+				Failed:   task.Failed,
+			}
+			if task.Checksum != "" {
+				_, err := os.Stat(y.getCacheLoc(task.Checksum))
+				result.Cached = err == nil
+			} else if task.Key != "" {
+				_, err := os.Stat(y.getActionLoc(task.Key))
+				result.Cached = err == nil
+			}
+			results = append(results, result)
+		}
+	}
+	return results, nil
+}
+
+// CacheProblem is a corrupt entry found by VerifyCache
+type CacheProblem struct {
+	// Kind is "blob", "output" or "action"
+	Kind   string
+	Digest string
+	Err    error
+}
+
+func (p CacheProblem) String() string {
+	return fmt.Sprintf("%s %s: %s", p.Kind, p.Digest, p.Err)
+}
+
+// VerifyCache re-hashes everything in the cache, checking blobs against their
+// digests and outputs against their checksums. With fix, corrupt entries are
+// removed so they're rebuilt, this waits for running builds to finish.
+func (y *Yabs) VerifyCache(fix bool) ([]CacheProblem, error) {
+	lk, err := y.cacheLock()
+	if err != nil {
+		return nil, err
+	}
+	if fix {
+		err = lk.Lock()
+	} else {
+		err = lk.RLock()
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer lk.Unlock()
+
+	problems := []CacheProblem{}
+	remove := func(loc string) error {
+		if !fix {
+			return nil
+		}
+		if err := os.Remove(loc); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+
+	blobList, err := y.listCache("blobs")
+	if err != nil {
+		return nil, err
+	}
+	corrupt := map[string]bool{}
+	for _, f := range blobList {
+		if err := verifyBlob(f.loc, f.digest); err != nil {
+			corrupt[f.digest] = true
+			problems = append(problems, CacheProblem{Kind: "blob", Digest: f.digest, Err: err})
+			if err := remove(f.loc); err != nil {
+				return problems, err
+			}
+		}
+	}
+
+	trees, err := y.listCache("trees")
+	if err != nil {
+		return problems, err
+	}
+	for _, f := range trees {
+		if err := y.verifyTree(f.digest, corrupt); err != nil {
+			problems = append(problems, CacheProblem{Kind: "output", Digest: f.digest, Err: err})
+			if err := remove(f.loc); err != nil {
+				return problems, err
+			}
+		}
+	}
+
+	actions, err := y.listCache("actions")
+	if err != nil {
+		return problems, err
+	}
+	for _, f := range actions {
+		res := actionResult{}
+		bs, err := os.ReadFile(f.loc)
+		if err == nil {
+			err = json.Unmarshal(bs, &res)
+		}
+		if err == nil && res.Checksum != "" && !isDigest(res.Checksum) {
+			err = fmt.Errorf("invalid checksum %q", res.Checksum)
+		}
+		if err != nil {
+			problems = append(problems, CacheProblem{Kind: "action", Digest: f.digest, Err: err})
+			if err := remove(f.loc); err != nil {
+				return problems, err
+			}
+		}
+	}
+	return problems, nil
+}
+
+func verifyBlob(loc, digest string) error {
+	f, err := os.Open(loc)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return err
+	}
+	if got := hex.EncodeToString(h.Sum(nil)); got != digest {
+		return fmt.Errorf("contents hash to %s", got)
+	}
+	return nil
+}
+
+// verifyTree checks an output's tree can be read, its blobs are there and
+// intact, and that they hash to the output's checksum
+func (y *Yabs) verifyTree(checksum string, corrupt map[string]bool) error {
+	tr, err := y.readTree(checksum)
+	if err != nil {
+		return err
+	}
+	for _, digest := range treeDigests(tr) {
+		if corrupt[digest] {
+			return fmt.Errorf("blob %s is corrupt", digest)
+		}
+		if _, err := os.Stat(y.getBlobLoc(digest)); err != nil {
+			return fmt.Errorf("blob %s is missing", digest)
+		}
+	}
+	got, ok, err := treeChecksum(tr)
+	if err != nil {
+		return err
+	}
+	if ok && got != checksum {
+		return fmt.Errorf("contents hash to %s", got)
+	}
+	return nil
+}
+
+// treeChecksum computes an output's checksum from its tree the way
+// checksumEntries does from the filesystem. ok is false for a
+// symlinked file output, its checksum is of a file outside the cache.
+func treeChecksum(tr tree) (sum string, ok bool, err error) {
+	if len(tr.Entries) == 0 {
+		return "", false, fmt.Errorf("tree is empty")
+	}
+	root := tr.Entries[0]
+	switch {
+	case root.Mode.IsDir():
+		return tr.checksum(), true, nil
+	case root.Mode.IsRegular():
+		return fileChecksum(root.Digest, root.Mode), true, nil
+	}
+	return "", false, nil
+}
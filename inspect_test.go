@@ -0,0 +1,162 @@
+package yabs
+
+import (
+	"os"
+	"testing"
+)
+
+func TestCacheStats(t *testing.T) {
+	chdirTemp(t)
+
+	build := func() *Yabs {
+		y := New()
+		y.Register("out", []string{}, func(bc BuildCtx) error {
+			return os.WriteFile(bc.Out, []byte("one"), 0o644)
+		})
+		if err := y.ExecWithDefault("out"); err != nil {
+			t.Fatal(err)
+		}
+		return y
+	}
+
+	build()
+	build()
+	y := build()
+
+	stats, err := y.CacheStats(10, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Builds != 3 {
+		t.Fatalf("want 3 builds, got %d", stats.Builds)
+	}
+	if stats.Hits != 2 || stats.Misses != 1 {
+		t.Fatalf("want 2 hits and 1 miss, got %d hits and %d misses", stats.Hits, stats.Misses)
+	}
+	if stats.Outputs != 1 || len(stats.Biggest) != 1 {
+		t.Fatalf("want 1 output, got %d", stats.Outputs)
+	}
+	if got := stats.Biggest[0].Targets; len(got) != 1 || got[0] != "out" {
+		t.Fatalf("want the output to belong to \"out\", got %v", got)
+	}
+	if stats.Biggest[0].Size < int64(len("one")) {
+		t.Fatalf("want the output's size to include its blob, got %d", stats.Biggest[0].Size)
+	}
+
+	stats, err = y.CacheStats(1, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Hits != 1 || stats.Misses != 0 || len(stats.Biggest) != 0 {
+		t.Fatalf("want only the last build counted and no outputs listed, got %+v", stats)
+	}
+}
+
+func TestTargetHistory(t *testing.T) {
+	chdirTemp(t)
+
+	content := "one"
+	build := func() *Yabs {
+		y := New()
+		y.Register("out", []string{}, func(bc BuildCtx) error {
+			return os.WriteFile(bc.Out, []byte(content), 0o644)
+		}, WithAlwaysRun())
+		if err := y.ExecWithDefault("out"); err != nil {
+			t.Fatal(err)
+		}
+		return y
+	}
+
+	build()
+	content = "two"
+	y := build()
+
+	builds, err := y.TargetHistory("out")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(builds) != 2 {
+		t.Fatalf("want 2 builds, got %d", len(builds))
+	}
+	if builds[0].Checksum == builds[1].Checksum {
+		t.Fatal("want each build's checksum")
+	}
+	if builds[1].Checksum != y.taskKV["out"].Checksum {
+		t.Fatal("want the last build last")
+	}
+	for _, build := range builds {
+		if !build.Cached {
+			t.Fatalf("want %s to still be cached", build.Checksum)
+		}
+	}
+
+	if builds, err := y.TargetHistory("missing"); err != nil || len(builds) != 0 {
+		t.Fatalf("want no history for an unknown target, got %v, %v", builds, err)
+	}
+}
+
+func TestVerifyCache(t *testing.T) {
+	chdirTemp(t)
+
+	y := New()
+	y.Register("file", []string{}, func(bc BuildCtx) error {
+		return os.WriteFile(bc.Out, []byte("file"), 0o644)
+	})
+	y.Register("dir", []string{}, func(bc BuildCtx) error {
+		if err := os.MkdirAll(bc.Out+"/sub", 0o755); err != nil {
+			return err
+		}
+		if err := os.WriteFile(bc.Out+"/sub/a", []byte("a"), 0o644); err != nil {
+			return err
+		}
+		if err := os.WriteFile(bc.Out+"/b", []byte("b"), 0o644); err != nil {
+			return err
+		}
+		return os.Symlink("sub/a", bc.Out+"/link")
+	})
+	y.Register("default", []string{"file", "dir"}, func(bc BuildCtx) error { return nil }, WithAlwaysRun())
+	if err := y.ExecWithDefault("default"); err != nil {
+		t.Fatal(err)
+	}
+
+	problems, err := y.VerifyCache(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(problems) != 0 {
+		t.Fatalf("want an intact cache, got %v", problems)
+	}
+
+	blob := y.getBlobLoc(digestBytes([]byte("file")).Hash)
+	if err := os.Chmod(blob, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(blob, []byte("corrupt"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	problems, err = y.VerifyCache(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(problems) != 2 || problems[0].Kind != "blob" || problems[1].Kind != "output" {
+		t.Fatalf("want the corrupt blob and the output using it, got %v", problems)
+	}
+	if _, err := os.Stat(blob); err != nil {
+		t.Fatal("want nothing removed without fix")
+	}
+
+	if _, err := y.VerifyCache(true); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(y.getCacheLoc(y.taskKV["file"].Checksum)); err == nil {
+		t.Fatal("want the corrupt output removed with fix")
+	}
+	problems, err = y.VerifyCache(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(problems) != 0 {
+		t.Fatalf("want an intact cache after fixing it, got %v", problems)
+	}
+}
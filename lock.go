@@ -0,0 +1,65 @@
+package yabs
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// FileLock is an advisory lock on a file, used to share the cache and
+// toolchains between yabs processes
+type FileLock struct {
+	f *os.File
+}
+
+// OpenLock opens the lock file at path, creating it if needed, without taking
+// the lock
+func OpenLock(path string) (*FileLock, error) {
+	if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+		return nil, fmt.Errorf("creating lock dir: %w", err)
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("opening lock: %w", err)
+	}
+	return &FileLock{f: f}, nil
+}
+
+// Lock waits until no other process holds the lock
+func (l *FileLock) Lock() error {
+	if err := lockFile(l.f, true); err != nil {
+		return fmt.Errorf("locking %s: %w", l.f.Name(), err)
+	}
+	return nil
+}
+
+// RLock waits until no other process holds the lock exclusively, any number of
+// processes can hold it shared at once
+func (l *FileLock) RLock() error {
+	if err := lockFile(l.f, false); err != nil {
+		return fmt.Errorf("locking %s: %w", l.f.Name(), err)
+	}
+	return nil
+}
+
+// TryLock takes the lock exclusively if no other process holds it, ok is false
+// if it's held
+func (l *FileLock) TryLock() (ok bool, err error) {
+	ok, err = tryLockFile(l.f)
+	if err != nil {
+		return false, fmt.Errorf("locking %s: %w", l.f.Name(), err)
+	}
+	return ok, nil
+}
+
+// Unlock releases the lock and closes the lock file
+func (l *FileLock) Unlock() error {
+	err := unlockFile(l.f)
+	if closeErr := l.f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("unlocking %s: %w", l.f.Name(), err)
+	}
+	return nil
+}
@@ -0,0 +1,137 @@
+package yabs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFileLock(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "lock")
+
+	first, err := OpenLock(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := first.Lock(); err != nil {
+		t.Fatal(err)
+	}
+
+	second, err := OpenLock(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	locked := make(chan error)
+	go func() {
+		locked <- second.RLock()
+	}()
+
+	select {
+	case <-locked:
+		t.Fatal("shared lock taken while the lock was held exclusively")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	if err := first.Unlock(); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-locked; err != nil {
+		t.Fatal(err)
+	}
+	if err := second.Unlock(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestProjectLock(t *testing.T) {
+	chdirTemp(t)
+
+	held, err := New().lockProject(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	y := New()
+	y.Register("default", []string{}, func(bc BuildCtx) error { return nil })
+	y.NoWait = true
+	err = y.ExecWithDefault("default")
+	if !errors.Is(err, ErrProjectLocked) {
+		t.Fatalf("want ErrProjectLocked, got %v", err)
+	}
+	if want := fmt.Sprintf("(pid %d)", os.Getpid()); !strings.Contains(err.Error(), want) {
+		t.Fatalf("want the error to name the holder %s, got %q", want, err)
+	}
+
+	y.NoWait = false
+	done := make(chan error)
+	go func() {
+		done <- y.ExecWithDefault("default")
+	}()
+	select {
+	case err := <-done:
+		t.Fatalf("build finished while another process held the project lock: %v", err)
+	case <-time.After(2 * projectLockPoll):
+	}
+	if err := held.Unlock(); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPruneLocksProject(t *testing.T) {
+	chdirTemp(t)
+
+	register := func(y *Yabs) {
+		y.Register("default", []string{}, func(bc BuildCtx) error {
+			return os.WriteFile(bc.Out, []byte("hi"), 0o644)
+		})
+	}
+	y := New()
+	register(y)
+	if err := y.ExecWithDefault("default"); err != nil {
+		t.Fatal(err)
+	}
+	out, err := y.getOutLoc(y.taskKV["default"].Checksum)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale := filepath.Join(".yabs", "out", "stale")
+	if err := os.Mkdir(stale, os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+
+	held, err := New().lockProject(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	y = New()
+	register(y)
+	y.NoWait = true
+	if err := y.Prune(); !errors.Is(err, ErrProjectLocked) {
+		t.Fatalf("want ErrProjectLocked, got %v", err)
+	}
+	if _, err := os.Stat(stale); err != nil {
+		t.Fatal("want nothing pruned while the project is locked")
+	}
+	if err := held.Unlock(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the records are read by prune itself, once it holds the lock
+	if err := y.Prune(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(stale); err == nil {
+		t.Fatal("want the unused output pruned")
+	}
+	if _, err := os.Stat(out); err != nil {
+		t.Fatalf("want the target's output kept: %s", err)
+	}
+}
@@ -0,0 +1,118 @@
+package yabs
+
+import (
+	"container/heap"
+	"context"
+	"sync"
+	"time"
+)
+
+// pool is a weighted semaphore that hands out capacity to the waiter with
+// the highest priority instead of the one that's been waiting the longest
+type pool struct {
+	mu      sync.Mutex
+	size    int64
+	used    int64
+	seq     int64
+	waiters waiterHeap
+}
+
+type waiter struct {
+	weight   int64
+	priority time.Duration
+	seq      int64
+	index    int
+	ready    chan struct{}
+}
+
+func newPool(size int64) *pool {
+	return &pool{size: size}
+}
+
+// Acquire blocks until weight is available and no waiter with a higher
+// priority is ahead of it, or ctx is done
+func (p *pool) Acquire(ctx context.Context, weight int64, priority time.Duration) error {
+	p.mu.Lock()
+	if len(p.waiters) == 0 && p.used+weight <= p.size {
+		p.used += weight
+		p.mu.Unlock()
+		return nil
+	}
+
+	w := &waiter{weight: weight, priority: priority, seq: p.seq, ready: make(chan struct{})}
+	p.seq++
+	heap.Push(&p.waiters, w)
+	p.mu.Unlock()
+
+	select {
+	case <-w.ready:
+		return nil
+	case <-ctx.Done():
+		p.mu.Lock()
+		select {
+		case <-w.ready:
+			// got it just as ctx was done, give it back
+			p.used -= weight
+		default:
+			heap.Remove(&p.waiters, w.index)
+		}
+		p.notify()
+		p.mu.Unlock()
+		return ctx.Err()
+	}
+}
+
+func (p *pool) Release(weight int64) {
+	p.mu.Lock()
+	p.used -= weight
+	p.notify()
+	p.mu.Unlock()
+}
+
+// notify wakes waiters in priority order for as long as they fit, p.mu must be
+// held
+func (p *pool) notify() {
+	for len(p.waiters) > 0 {
+		next := p.waiters[0]
+		if p.used+next.weight > p.size {
+			return
+		}
+		p.used += next.weight
+		heap.Pop(&p.waiters)
+		close(next.ready)
+	}
+}
+
+// waiterHeap orders waiters by highest priority first, then first come first
+// served
+type waiterHeap []*waiter
+
+func (h waiterHeap) Len() int { return len(h) }
+
+func (h waiterHeap) Less(i, j int) bool {
+	if h[i].priority != h[j].priority {
+		return h[i].priority > h[j].priority
+	}
+	return h[i].seq < h[j].seq
+}
+
+func (h waiterHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *waiterHeap) Push(x any) {
+	w := x.(*waiter)
+	w.index = len(*h)
+	*h = append(*h, w)
+}
+
+func (h *waiterHeap) Pop() any {
+	old := *h
+	n := len(old)
+	w := old[n-1]
+	old[n-1] = nil
+	*h = old[:n-1]
+	return w
+}
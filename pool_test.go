@@ -0,0 +1,70 @@
+package yabs
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/exp/slices"
+)
+
+func TestPoolPriority(t *testing.T) {
+	p := newPool(1)
+	ctx := context.Background()
+	if err := p.Acquire(ctx, 1, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	var mu sync.Mutex
+	order := []time.Duration{}
+	var wg sync.WaitGroup
+	for _, priority := range []time.Duration{1, 3, 2} {
+		wg.Add(1)
+		go func(priority time.Duration) {
+			defer wg.Done()
+			if err := p.Acquire(ctx, 1, priority); err != nil {
+				t.Error(err)
+				return
+			}
+			mu.Lock()
+			order = append(order, priority)
+			mu.Unlock()
+			p.Release(1)
+		}(priority)
+	}
+	// wait for every goroutine to be queued up before letting them through
+	for {
+		p.mu.Lock()
+		queued := len(p.waiters)
+		p.mu.Unlock()
+		if queued == 3 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	p.Release(1)
+	wg.Wait()
+
+	if want := []time.Duration{3, 2, 1}; slices.Compare(order, want) != 0 {
+		t.Fatalf("want order=%v, got=%v", want, order)
+	}
+}
+
+func TestPoolAcquireCancelled(t *testing.T) {
+	p := newPool(1)
+	if err := p.Acquire(context.Background(), 1, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := p.Acquire(ctx, 1, 0); err == nil {
+		t.Fatal("want an error acquiring from a full pool with a cancelled context")
+	}
+
+	p.Release(1)
+	if err := p.Acquire(context.Background(), 1, 0); err != nil {
+		t.Fatalf("cancelled waiter should have left the pool: %s", err)
+	}
+}
@@ -0,0 +1,19 @@
+package yabs
+
+import (
+	"context"
+	"os/exec"
+	"time"
+)
+
+// killDelay is how long a cancelled command gets to exit before it's killed
+const killDelay = 5 * time.Second
+
+// CommandContext is like exec.CommandContext, except that cancelling ctx
+// terminates the command's whole process group instead of only the command
+func CommandContext(ctx context.Context, name string, args ...string) *exec.Cmd {
+	cmd := exec.CommandContext(ctx, name, args...)
+	setProcessGroup(cmd)
+	cmd.WaitDelay = killDelay
+	return cmd
+}
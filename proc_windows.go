@@ -0,0 +1,8 @@
+//go:build windows
+
+package yabs
+
+import "os/exec"
+
+// setProcessGroup is a no-op on windows, cancelling kills the command itself
+func setProcessGroup(cmd *exec.Cmd) {}
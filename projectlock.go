@@ -0,0 +1,78 @@
+package yabs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrProjectLocked is returned when another yabs process is using the project
+// and NoWait is set
+var ErrProjectLocked = errors.New("another yabs process is using the project")
+
+// projectLockPoll is how often a build waiting for the project lock checks if
+// it's been released
+const projectLockPoll = 100 * time.Millisecond
+
+func (y *Yabs) projectLockLoc() string {
+	return filepath.Join(y.tmpDir, "lock")
+}
+
+// lockProject takes the lock on the project's .yabs dir, so builds in the same
+// project don't race on its records and outputs. It waits for another process
+// holding it unless NoWait is set, or until ctx is done.
+func (y *Yabs) lockProject(ctx context.Context) (*FileLock, error) {
+	lk, err := OpenLock(y.projectLockLoc())
+	if err != nil {
+		return nil, err
+	}
+	for waiting := false; ; waiting = true {
+		ok, err := lk.TryLock()
+		if err != nil {
+			_ = lk.Unlock()
+			return nil, err
+		}
+		if ok {
+			break
+		}
+		if !waiting {
+			if y.NoWait {
+				_ = lk.Unlock()
+				return nil, fmt.Errorf("%w%s", ErrProjectLocked, y.projectLockHolder())
+			}
+			log.Printf("waiting for another yabs process%s", y.projectLockHolder())
+		}
+		select {
+		case <-ctx.Done():
+			_ = lk.Unlock()
+			return nil, fmt.Errorf("waiting for another yabs process: %w", ctx.Err())
+		case <-time.After(projectLockPoll):
+		}
+	}
+	// the lock file itself can't be read while it's locked on windows
+	if err := os.WriteFile(y.projectLockLoc()+".pid", []byte(strconv.Itoa(os.Getpid())), 0o644); err != nil {
+		_ = lk.Unlock()
+		return nil, fmt.Errorf("writing lock holder: %w", err)
+	}
+	return lk, nil
+}
+
+// projectLockHolder describes the process holding the project lock, for
+// messages about waiting for it
+func (y *Yabs) projectLockHolder() string {
+	bs, err := os.ReadFile(y.projectLockLoc() + ".pid")
+	if err != nil {
+		return ""
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(bs)))
+	if err != nil {
+		return ""
+	}
+	return fmt.Sprintf(" (pid %d)", pid)
+}
@@ -0,0 +1,334 @@
+package yabs
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"sort"
+
+	repb "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/anypb"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+// Actions are stored in a remote cache as REAPI ActionResults, so they can be
+// kept in a cache that's shared with Bazel. A task's output is the result's
+// single output at outPath, a directory output is stored as a Tree in the CAS.
+// The output's checksum is kept in the result's auxiliary metadata.
+
+// outPath is the path of a task's output in its ActionResult
+const outPath = "out"
+
+// Digest identifies a blob in a remote cache by the sha256 of its contents and
+// its size
+type Digest struct {
+	Hash string
+	Size int64
+}
+
+func (d Digest) String() string {
+	return fmt.Sprintf("%s/%d", d.Hash, d.Size)
+}
+
+func (d Digest) proto() *repb.Digest {
+	return &repb.Digest{Hash: d.Hash, SizeBytes: d.Size}
+}
+
+func digestFromProto(d *repb.Digest) (Digest, error) {
+	if d == nil || !isDigest(d.Hash) || d.SizeBytes < 0 {
+		return Digest{}, fmt.Errorf("invalid digest %v", d)
+	}
+	return Digest{Hash: d.Hash, Size: d.SizeBytes}, nil
+}
+
+func digestBytes(bs []byte) Digest {
+	sum := sha256.Sum256(bs)
+	return Digest{Hash: hex.EncodeToString(sum[:]), Size: int64(len(bs))}
+}
+
+// marshalDigest serializes a message the same way each time, so equal
+// directories get the same digest
+func marshalDigest(m proto.Message) ([]byte, Digest, error) {
+	bs, err := proto.MarshalOptions{Deterministic: true}.Marshal(m)
+	if err != nil {
+		return nil, Digest{}, err
+	}
+	return bs, digestBytes(bs), nil
+}
+
+func nodeProperties(mode fs.FileMode) *repb.NodeProperties {
+	return &repb.NodeProperties{UnixMode: wrapperspb.UInt32(uint32(mode.Perm()))}
+}
+
+// permFromProto is the permissions from a node's properties, falling back to
+// what's implied by the node when they're not set
+func permFromProto(props *repb.NodeProperties, fallback fs.FileMode) fs.FileMode {
+	if props == nil || props.UnixMode == nil {
+		return fallback
+	}
+	return fs.FileMode(props.UnixMode.Value).Perm()
+}
+
+func filePerm(props *repb.NodeProperties, executable bool) fs.FileMode {
+	if executable {
+		return permFromProto(props, 0o755) | 0o111
+	}
+	return permFromProto(props, 0o644)
+}
+
+// remoteResult is an action converted to an ActionResult, along with the
+// blobs it refers to
+type remoteResult struct {
+	result *repb.ActionResult
+	// blobs are the digests of the output's files, stored in the local cache
+	blobs []Digest
+	// tree is the encoded Tree of a directory output, it isn't in the local
+	// cache so it's uploaded from memory
+	tree       []byte
+	treeDigest Digest
+}
+
+// encodeAction converts a locally cached action into an ActionResult
+func (y *Yabs) encodeAction(res actionResult) (remoteResult, error) {
+	rr := remoteResult{result: &repb.ActionResult{}}
+	checksum, err := anypb.New(wrapperspb.String(res.Checksum))
+	if err != nil {
+		return rr, err
+	}
+	rr.result.ExecutionMetadata = &repb.ExecutedActionMetadata{
+		Worker:            "yabs",
+		AuxiliaryMetadata: []*anypb.Any{checksum},
+	}
+	if res.Checksum == "" {
+		return rr, nil
+	}
+
+	tr, err := y.readTree(res.Checksum)
+	if err != nil {
+		return rr, err
+	}
+	sizes := map[string]int64{}
+	blobDigest := func(digest string) (*repb.Digest, error) {
+		size, ok := sizes[digest]
+		if !ok {
+			st, err := os.Stat(y.getBlobLoc(digest))
+			if err != nil {
+				return nil, fmt.Errorf("stat blob: %w", err)
+			}
+			size = st.Size()
+			sizes[digest] = size
+			rr.blobs = append(rr.blobs, Digest{Hash: digest, Size: size})
+		}
+		return &repb.Digest{Hash: digest, SizeBytes: size}, nil
+	}
+
+	if len(tr.Entries) == 0 {
+		return rr, fmt.Errorf("tree of %s is empty", res.Checksum)
+	}
+	if root := tr.Entries[0]; root.Path == "." && !root.Mode.IsDir() {
+		switch {
+		case root.Mode&fs.ModeSymlink != 0:
+			rr.result.OutputSymlinks = []*repb.OutputSymlink{{Path: outPath, Target: root.Link}}
+		default:
+			digest, err := blobDigest(root.Digest)
+			if err != nil {
+				return rr, err
+			}
+			rr.result.OutputFiles = []*repb.OutputFile{{
+				Path:           outPath,
+				Digest:         digest,
+				IsExecutable:   root.Mode&0o111 != 0,
+				NodeProperties: nodeProperties(root.Mode),
+			}}
+		}
+		return rr, nil
+	}
+
+	dirs := map[string]*repb.Directory{}
+	dirPaths := []string{}
+	for _, entry := range tr.Entries {
+		if entry.Mode.IsDir() {
+			dirs[entry.Path] = &repb.Directory{NodeProperties: nodeProperties(entry.Mode)}
+			dirPaths = append(dirPaths, entry.Path)
+			continue
+		}
+		parent, ok := dirs[path.Dir(entry.Path)]
+		if !ok {
+			return rr, fmt.Errorf("%q: parent dir isn't in the tree", entry.Path)
+		}
+		name := path.Base(entry.Path)
+		switch {
+		case entry.Mode&fs.ModeSymlink != 0:
+			parent.Symlinks = append(parent.Symlinks, &repb.SymlinkNode{Name: name, Target: entry.Link})
+		default:
+			digest, err := blobDigest(entry.Digest)
+			if err != nil {
+				return rr, err
+			}
+			parent.Files = append(parent.Files, &repb.FileNode{
+				Name:           name,
+				Digest:         digest,
+				IsExecutable:   entry.Mode&0o111 != 0,
+				NodeProperties: nodeProperties(entry.Mode),
+			})
+		}
+	}
+	root, ok := dirs["."]
+	if !ok {
+		return rr, fmt.Errorf("tree of %s has no root", res.Checksum)
+	}
+
+	// children are finished before their parents so their digests are known
+	sort.SliceStable(dirPaths, func(i, j int) bool {
+		return depth(dirPaths[i]) > depth(dirPaths[j])
+	})
+	treeMsg := &repb.Tree{Root: root}
+	seen := map[string]bool{}
+	for _, p := range dirPaths {
+		dir := dirs[p]
+		sortNodes(dir)
+		if p == "." {
+			continue
+		}
+		_, digest, err := marshalDigest(dir)
+		if err != nil {
+			return rr, err
+		}
+		parent := dirs[path.Dir(p)]
+		parent.Directories = append(parent.Directories, &repb.DirectoryNode{Name: path.Base(p), Digest: digest.proto()})
+		if !seen[digest.Hash] {
+			seen[digest.Hash] = true
+			treeMsg.Children = append(treeMsg.Children, dir)
+		}
+	}
+
+	rr.tree, rr.treeDigest, err = marshalDigest(treeMsg)
+	if err != nil {
+		return rr, err
+	}
+	rr.result.OutputDirectories = []*repb.OutputDirectory{{Path: outPath, TreeDigest: rr.treeDigest.proto()}}
+	return rr, nil
+}
+
+func depth(p string) int {
+	if p == "." {
+		return 0
+	}
+	n := 1
+	for _, c := range p {
+		if c == '/' {
+			n++
+		}
+	}
+	return n
+}
+
+// sortNodes sorts a directory's nodes by name, as REAPI requires
+func sortNodes(dir *repb.Directory) {
+	sort.Slice(dir.Files, func(i, j int) bool { return dir.Files[i].Name < dir.Files[j].Name })
+	sort.Slice(dir.Directories, func(i, j int) bool { return dir.Directories[i].Name < dir.Directories[j].Name })
+	sort.Slice(dir.Symlinks, func(i, j int) bool { return dir.Symlinks[i].Name < dir.Symlinks[j].Name })
+}
+
+// resultChecksum is the output checksum stored in an ActionResult by yabs,
+// ok is false for results stored by something else
+func resultChecksum(result *repb.ActionResult) (string, bool) {
+	if result.ExecutionMetadata == nil {
+		return "", false
+	}
+	for _, aux := range result.ExecutionMetadata.AuxiliaryMetadata {
+		s := &wrapperspb.StringValue{}
+		if aux.MessageIs(s) && aux.UnmarshalTo(s) == nil {
+			return s.Value, true
+		}
+	}
+	return "", false
+}
+
+// decodeTree converts a directory output's Tree into a tree, returning the
+// digests of the blobs it refers to
+func decodeTree(treeMsg *repb.Tree) (tree, []Digest, error) {
+	tr := tree{}
+	blobs := []Digest{}
+	if treeMsg.Root == nil {
+		return tr, nil, fmt.Errorf("tree has no root")
+	}
+	children := map[string]*repb.Directory{}
+	for _, child := range treeMsg.Children {
+		_, digest, err := marshalDigest(child)
+		if err != nil {
+			return tr, nil, err
+		}
+		children[digest.Hash] = child
+	}
+
+	var walk func(p string, dir *repb.Directory, depth int) error
+	walk = func(p string, dir *repb.Directory, depth int) error {
+		if depth > 1024 {
+			return fmt.Errorf("%q: tree is too deep", p)
+		}
+		tr.Entries = append(tr.Entries, treeEntry{Path: p, Mode: fs.ModeDir | permFromProto(dir.NodeProperties, 0o755)})
+
+		// entries are kept in the order fs.WalkDir would find them
+		type node struct {
+			name string
+			add  func(p string) error
+		}
+		nodes := []node{}
+		for _, f := range dir.Files {
+			f := f
+			nodes = append(nodes, node{f.Name, func(p string) error {
+				digest, err := digestFromProto(f.Digest)
+				if err != nil {
+					return fmt.Errorf("%q: %w", p, err)
+				}
+				blobs = append(blobs, digest)
+				tr.Entries = append(tr.Entries, treeEntry{Path: p, Mode: filePerm(f.NodeProperties, f.IsExecutable), Digest: digest.Hash})
+				return nil
+			}})
+		}
+		for _, s := range dir.Symlinks {
+			s := s
+			nodes = append(nodes, node{s.Name, func(p string) error {
+				tr.Entries = append(tr.Entries, treeEntry{Path: p, Mode: fs.ModeSymlink | 0o777, Link: s.Target})
+				return nil
+			}})
+		}
+		for _, d := range dir.Directories {
+			d := d
+			nodes = append(nodes, node{d.Name, func(p string) error {
+				if d.Digest == nil {
+					return fmt.Errorf("%q: directory has no digest", p)
+				}
+				child, ok := children[d.Digest.Hash]
+				if !ok {
+					return fmt.Errorf("%q: directory isn't in the tree", p)
+				}
+				return walk(p, child, depth+1)
+			}})
+		}
+		sort.Slice(nodes, func(i, j int) bool { return nodes[i].name < nodes[j].name })
+		for i, n := range nodes {
+			if !fs.ValidPath(n.name) || n.name == "." || path.Base(n.name) != n.name {
+				return fmt.Errorf("%q: invalid name %q", p, n.name)
+			}
+			// a symlink and a directory with the same name could have the
+			// directory's files written wherever the symlink points
+			if i > 0 && nodes[i-1].name == n.name {
+				return fmt.Errorf("%q: duplicate name %q", p, n.name)
+			}
+			if err := n.add(path.Join(p, n.name)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if err := walk(".", treeMsg.Root, 0); err != nil {
+		return tr, nil, err
+	}
+	return tr, blobs, nil
+}
@@ -0,0 +1,306 @@
+package yabs
+
+import (
+	"context"
+	"fmt"
+
+	"golang.org/x/exp/slices"
+)
+
+// ReasonKind is the kind of decision made about whether a task needs to run
+type ReasonKind int
+
+const (
+	UpToDate ReasonKind = iota
+	AlwaysRuns
+	NoRecord
+	DepsChanged
+	DepChanged
+	DepRan
+	FnChanged
+	EnvChanged
+	InputsChanged
+	NotCached
+	DepWouldRun
+	RemoteCached
+)
+
+// reasonKindNames are how reason kinds are stored in task records
+var reasonKindNames = []string{
+	UpToDate:      "up-to-date",
+	AlwaysRuns:    "always-runs",
+	NoRecord:      "no-record",
+	DepsChanged:   "deps-changed",
+	DepChanged:    "dep-changed",
+	DepRan:        "dep-ran",
+	FnChanged:     "fn-changed",
+	EnvChanged:    "env-changed",
+	InputsChanged: "inputs-changed",
+	NotCached:     "not-cached",
+	DepWouldRun:   "dep-would-run",
+	RemoteCached:  "remote-cached",
+}
+
+func (k ReasonKind) MarshalText() ([]byte, error) {
+	if int(k) < 0 || int(k) >= len(reasonKindNames) {
+		return nil, fmt.Errorf("unknown reason kind %d", k)
+	}
+	return []byte(reasonKindNames[k]), nil
+}
+
+func (k *ReasonKind) UnmarshalText(text []byte) error {
+	i := slices.Index(reasonKindNames, string(text))
+	if i < 0 {
+		return fmt.Errorf("unknown reason kind %q", text)
+	}
+	*k = ReasonKind(i)
+	return nil
+}
+
+// Reason is why a task was run or skipped
+type Reason struct {
+	Kind ReasonKind
+	// Dep is the dependency responsible, if any
+	Dep string `json:",omitempty"`
+	// Env is the env var responsible, if any
+	Env string `json:",omitempty"`
+}
+
+// Dirty reports whether the task needs to run
+func (r Reason) Dirty() bool {
+	return r.Kind != UpToDate && r.Kind != RemoteCached
+}
+
+func (r Reason) String() string {
+	switch r.Kind {
+	case UpToDate:
+		return "up to date"
+	case AlwaysRuns:
+		return "always runs"
+	case NoRecord:
+		return "no record of a previous run"
+	case DepsChanged:
+		return "deps list changed"
+	case DepChanged:
+		return fmt.Sprintf("dep %q produced a new checksum", r.Dep)
+	case DepRan:
+		return fmt.Sprintf("dep %q ran", r.Dep)
+	case FnChanged:
+		return "function changed"
+	case EnvChanged:
+		return fmt.Sprintf("env var %q changed", r.Env)
+	case InputsChanged:
+		return "inputs changed"
+	case NotCached:
+		return "no cached result"
+	case DepWouldRun:
+		return fmt.Sprintf("dep %q would run", r.Dep)
+	case RemoteCached:
+		return "would restore from remote"
+	}
+	return "unknown"
+}
+
+// dirtyReason decides whether t needs to run now that its deps have finished
+// and its action key is known, the cached result is returned if it doesn't.
+// The remote cache is checked when the action isn't cached locally.
+func (y *Yabs) dirtyReason(ctx context.Context, t *Task, deps []*Task) (Reason, *actionResult, error) {
+	if t.AlwaysRun {
+		return Reason{Kind: AlwaysRuns}, nil, nil
+	}
+	res, ok, err := y.lookupAction(t.Key)
+	if err != nil {
+		return Reason{}, nil, err
+	}
+	if !ok {
+		res, ok = y.fetchAction(ctx, t.Key)
+	}
+	if ok {
+		return Reason{Kind: UpToDate}, &res, nil
+	}
+	return y.missReason(t, deps), nil, nil
+}
+
+// plannedReason is dirtyReason for a dry run, which leaves the cache alone:
+// cached entries aren't marked as used and an action in the remote cache is
+// reported without being fetched
+func (y *Yabs) plannedReason(ctx context.Context, t *Task, deps []*Task) (Reason, *actionResult, error) {
+	res, ok, err := y.readAction(t.Key)
+	if err != nil {
+		return Reason{}, nil, err
+	}
+	if ok {
+		return Reason{Kind: UpToDate}, &res, nil
+	}
+	if _, checksum, ok := y.remoteAction(ctx, t.Key); ok {
+		return Reason{Kind: RemoteCached}, &actionResult{Checksum: checksum}, nil
+	}
+	return y.missReason(t, deps), nil, nil
+}
+
+// missReason explains why there's no cached result for t by comparing it with
+// its last record
+func (y *Yabs) missReason(t *Task, deps []*Task) Reason {
+	rec, ok := y.records[t.Name]
+	switch {
+	case !ok:
+		return Reason{Kind: NoRecord}
+	case slices.Compare(t.Dep, rec.Deps) != 0:
+		return Reason{Kind: DepsChanged}
+	}
+	for _, dep := range deps {
+		if dep.digest() == rec.DepDigests[dep.Name] {
+			continue
+		}
+		if dep.Checksum != "" {
+			return Reason{Kind: DepChanged, Dep: dep.Name}
+		}
+		return Reason{Kind: DepRan, Dep: dep.Name}
+	}
+	if t.FnHash != rec.FnHash {
+		return Reason{Kind: FnChanged}
+	}
+	env := slices.Clone(t.Env)
+	slices.Sort(env)
+	for _, name := range env {
+		if t.envDigests[name] != rec.Env[name] {
+			return Reason{Kind: EnvChanged, Env: name}
+		}
+	}
+	if t.Key != rec.Key {
+		return Reason{Kind: InputsChanged}
+	}
+	return Reason{Kind: NotCached}
+}
+
+// PlannedTask is a target visited by a dry run and whether it would run
+type PlannedTask struct {
+	Target string
+	Reason Reason
+}
+
+// DryRun walks the targets' dependencies in the order a serial build would
+// run them, deciding which ones would run without running anything. A dep
+// that would run is assumed to change its output, except for targets that
+// always run whose output can be predicted by their Plan, like the files
+// matched by Fs.
+func (y *Yabs) DryRun(targets []string) ([]PlannedTask, error) {
+	if err := y.Validate(targets...); err != nil {
+		return nil, err
+	}
+	// nothing is evicted while the cache is read
+	lk, err := y.cacheLock()
+	if err != nil {
+		return nil, err
+	}
+	if err := lk.RLock(); err != nil {
+		return nil, err
+	}
+	defer lk.Unlock()
+	if err := y.RestoreTasks(); err != nil {
+		return nil, err
+	}
+	// files hashed by plans aren't read again if they haven't changed, the
+	// stat cache isn't saved
+	y.hashes = y.loadStatCache()
+
+	plan := []PlannedTask{}
+	planned := map[string]*Task{}
+	var visit func(name string) (*Task, error)
+	visit = func(name string) (*Task, error) {
+		if t, ok := planned[name]; ok {
+			return t, nil
+		}
+		task := y.taskKV[name]
+		deps := []*Task{}
+		wouldRun := ""
+		for _, dep := range task.Dep {
+			depTask, err := visit(dep)
+			if err != nil {
+				return nil, err
+			}
+			if depTask.Dirty && wouldRun == "" {
+				wouldRun = dep
+			}
+			deps = append(deps, depTask)
+		}
+
+		// a copy so the real task's state is untouched
+		shadow := *task
+		var reason Reason
+		switch {
+		case task.AlwaysRun:
+			reason = Reason{Kind: AlwaysRuns}
+			shadow.computeKey(deps)
+			shadow.Dirty = true
+			if task.Plan != nil && wouldRun == "" {
+				checksum, ok, err := task.Plan(y.records[name].Checksum)
+				if err != nil {
+					return nil, fmt.Errorf("planning %q: %w", name, err)
+				}
+				if ok {
+					shadow.Checksum = checksum
+					shadow.Dirty = false
+				}
+			}
+		case wouldRun != "":
+			// the key can't be known until the dep has run
+			shadow.computeKey(deps)
+			reason = y.missReason(&shadow, deps)
+			if reason.Kind != NoRecord && reason.Kind != DepsChanged {
+				reason = Reason{Kind: DepWouldRun, Dep: wouldRun}
+			}
+			shadow.Dirty = true
+		default:
+			shadow.computeKey(deps)
+			var res *actionResult
+			var err error
+			reason, res, err = y.plannedReason(context.Background(), &shadow, deps)
+			if err != nil {
+				return nil, err
+			}
+			if res != nil {
+				shadow.Checksum = res.Checksum
+			}
+			shadow.Dirty = reason.Dirty()
+		}
+		planned[name] = &shadow
+		plan = append(plan, PlannedTask{Target: name, Reason: reason})
+		return &shadow, nil
+	}
+	for _, target := range targets {
+		if _, err := visit(target); err != nil {
+			return nil, err
+		}
+	}
+	return plan, nil
+}
+
+// Explanation is the recorded reason a target ran or was skipped
+type Explanation struct {
+	Target string
+	// Recorded is false if the target has never been recorded
+	Recorded bool
+	Reason   Reason
+}
+
+// Explain follows the recorded reasons for why target last ran or was
+// skipped through the deps responsible
+func (y *Yabs) Explain(target string) ([]Explanation, error) {
+	if _, ok := y.taskKV[target]; !ok {
+		return nil, fmt.Errorf("%q task not found", target)
+	}
+	if err := y.RestoreTasks(); err != nil {
+		return nil, err
+	}
+
+	explanations := []Explanation{}
+	seen := map[string]bool{}
+	for name := target; name != "" && !seen[name]; {
+		seen[name] = true
+		rec, ok := y.records[name]
+		explanations = append(explanations, Explanation{Target: name, Recorded: ok, Reason: rec.Reason})
+		name = rec.Reason.Dep
+	}
+	return explanations, nil
+}
@@ -0,0 +1,150 @@
+package yabs
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+// recordsVersion is the version of the records file, bump it and handle the
+// old version in migrateRecords when the file changes in a way older versions
+// can't read
+//
+//	1: a bare list of records
+//	2: the list of records along with the file's version
+const recordsVersion = 2
+
+// recordsFile is how task records are saved
+type recordsFile struct {
+	Version int
+	Records []TaskRecord
+}
+
+// encodeRecords encodes records as the current version of the records file
+func encodeRecords(records []TaskRecord) ([]byte, error) {
+	return json.MarshalIndent(recordsFile{Version: recordsVersion, Records: records}, "", "	")
+}
+
+// decodeRecords reads any version of the records file. A record that can't be
+// read, like one with a reason kind from a newer version, is skipped with a
+// warning so the rest can still be used.
+func decodeRecords(bs []byte) ([]TaskRecord, error) {
+	file := struct {
+		Version int
+		Records []json.RawMessage
+	}{}
+	bs = bytes.TrimSpace(bs)
+	if len(bs) > 0 && bs[0] == '[' {
+		file.Version = 1
+		if err := json.Unmarshal(bs, &file.Records); err != nil {
+			return nil, err
+		}
+	} else if err := json.Unmarshal(bs, &file); err != nil {
+		return nil, err
+	}
+	switch {
+	case file.Version > recordsVersion:
+		return nil, fmt.Errorf("version %d is from a newer yabs, this one reads up to version %d", file.Version, recordsVersion)
+	case file.Version < 1:
+		return nil, fmt.Errorf("unknown version %d", file.Version)
+	}
+
+	records := []TaskRecord{}
+	for _, raw := range file.Records {
+		rec := TaskRecord{}
+		if err := json.Unmarshal(raw, &rec); err != nil {
+			log.Printf("warning: skipping unreadable task record: %s", err)
+			continue
+		}
+		records = append(records, rec)
+	}
+	return migrateRecords(file.Version, records), nil
+}
+
+// migrateRecords brings records read from an older version of the file up to
+// date
+func migrateRecords(version int, records []TaskRecord) []TaskRecord {
+	// version 1 records are the same, only the file around them changed. Ones
+	// from before checksums were versioned are dropped by RestoreTasks.
+	return records
+}
+
+func (y *Yabs) journalLoc() string {
+	return filepath.Join(y.tmpDir, ".records.journal")
+}
+
+// journalTask appends the record of a task that just completed to the
+// journal, so it's remembered even if the build is killed before the records
+// are saved
+func (y *Yabs) journalTask(t *Task) error {
+	rec, ok := t.record()
+	if !ok {
+		return nil
+	}
+	bs, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	if y.journal == nil {
+		if err := os.MkdirAll(y.tmpDir, os.ModePerm); err != nil {
+			return fmt.Errorf("creating tmp dir: %w", err)
+		}
+		if y.journal, err = os.OpenFile(y.journalLoc(), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644); err != nil {
+			return err
+		}
+		// the last line of a journal left by a crash may have been cut
+		// short, it's ended so the next record starts on its own line
+		if st, err := y.journal.Stat(); err == nil && st.Size() > 0 {
+			bs = append([]byte{'\n'}, bs...)
+		}
+	}
+	// a single write, so a crash can only cut the last line short
+	_, err = y.journal.Write(append(bs, '\n'))
+	return err
+}
+
+// readJournal reads the records of tasks that completed since the records
+// were last saved, in the order they completed
+func (y *Yabs) readJournal() ([]TaskRecord, error) {
+	f, err := os.Open(y.journalLoc())
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("reading journal: %w", err)
+	}
+	defer f.Close()
+
+	records := []TaskRecord{}
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 64<<20)
+	for scanner.Scan() {
+		rec := TaskRecord{}
+		// a line cut short by a crash is skipped
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			continue
+		}
+		records = append(records, rec)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("reading journal: %w", err)
+	}
+	return migrateRecords(recordsVersion, records), nil
+}
+
+// removeJournal removes the journal once its records have been saved
+func (y *Yabs) removeJournal() error {
+	if y.journal != nil {
+		y.journal.Close()
+		y.journal = nil
+	}
+	if err := os.Remove(y.journalLoc()); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("removing journal: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,164 @@
+package yabs
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRestoreTasksRecovers(t *testing.T) {
+	tests := []struct {
+		name    string
+		records string
+		// want are the records expected to be restored
+		want []string
+	}{
+		{
+			name:    "truncated file",
+			records: `{"Version": 2, "Records": [{"Name": "a", "Checks`,
+		},
+		{
+			name:    "newer version",
+			records: `{"Version": 99, "Records": [{"Name": "a", "ChecksumVersion": 3}]}`,
+		},
+		{
+			name:    "version 1",
+			records: `[{"Name": "a", "ChecksumVersion": 3}, {"Name": "b", "ChecksumVersion": 3}]`,
+			want:    []string{"a", "b"},
+		},
+		{
+			name: "unknown reason kind",
+			records: `{"Version": 2, "Records": [
+				{"Name": "a", "ChecksumVersion": 3, "Reason": {"Kind": "from-the-future"}},
+				{"Name": "b", "ChecksumVersion": 3, "Reason": {"Kind": "up-to-date"}}
+			]}`,
+			want: []string{"b"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			chdirTemp(t)
+			if err := os.MkdirAll(".yabs", os.ModePerm); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(".yabs/.records.json", []byte(tt.records), 0o644); err != nil {
+				t.Fatal(err)
+			}
+
+			y := New()
+			for _, name := range []string{"a", "b"} {
+				y.Register(name, []string{}, func(bc BuildCtx) error { return nil })
+			}
+			if err := y.RestoreTasks(); err != nil {
+				t.Fatal(err)
+			}
+			if len(y.records) != len(tt.want) {
+				t.Fatalf("want %d records restored, got %v", len(tt.want), y.records)
+			}
+			for _, name := range tt.want {
+				if _, ok := y.records[name]; !ok {
+					t.Fatalf("want %q's record restored", name)
+				}
+			}
+
+			if err := y.ExecWithDefault("a"); err != nil {
+				t.Fatalf("want the build to go ahead: %s", err)
+			}
+			bs, err := os.ReadFile(".yabs/.records.json")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := decodeRecords(bs); err != nil {
+				t.Fatalf("want the records to be readable again: %s", err)
+			}
+		})
+	}
+}
+
+func TestSaveTasksVersioned(t *testing.T) {
+	chdirTemp(t)
+
+	y := New()
+	y.Register("default", []string{}, func(bc BuildCtx) error {
+		return os.WriteFile(bc.Out, []byte("hi"), 0o644)
+	})
+	if err := y.ExecWithDefault("default"); err != nil {
+		t.Fatal(err)
+	}
+
+	bs, err := os.ReadFile(".yabs/.records.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	file := recordsFile{}
+	if err := json.Unmarshal(bs, &file); err != nil {
+		t.Fatal(err)
+	}
+	if file.Version != recordsVersion || len(file.Records) != 1 {
+		t.Fatalf("want version %d with 1 record, got %+v", recordsVersion, file)
+	}
+	tmps, err := filepath.Glob(".yabs/.tmp-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tmps) != 0 {
+		t.Fatalf("want no temp files left behind, got %v", tmps)
+	}
+}
+
+func TestJournalRecoversKilledBuild(t *testing.T) {
+	chdirTemp(t)
+
+	register := func(y *Yabs) {
+		y.Register("done", []string{}, func(bc BuildCtx) error {
+			return os.WriteFile(bc.Out, []byte("hi"), 0o644)
+		})
+	}
+	// a build killed before its records were saved
+	y := New()
+	register(y)
+	ctx := y.scheduler.Start(context.Background())
+	<-y.scheduler.Schedule(ctx, y.taskKV["done"])
+	y.scheduler.Stop()
+	f, err := os.OpenFile(".yabs/.records.journal", os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteString(`{"Name": "cut sh`); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	y = New()
+	register(y)
+	if err := y.RestoreTasks(); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := y.records["done"]; !ok {
+		t.Fatal("want the completed task's record restored from the journal")
+	}
+	if err := y.journalTask(y.taskKV["done"]); err != nil {
+		t.Fatal(err)
+	}
+	if records, err := y.readJournal(); err != nil || len(records) != 2 {
+		t.Fatalf("want a record journaled after the cut line to be read, got %v, %v", records, err)
+	}
+
+	if err := y.ExecWithDefault("done"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(".yabs/.records.journal"); err == nil {
+		t.Fatal("want the journal removed once the records are saved")
+	}
+	y = New()
+	register(y)
+	if err := y.RestoreTasks(); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := y.records["done"]; !ok {
+		t.Fatal("want the record saved")
+	}
+}
@@ -0,0 +1,364 @@
+package yabs
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+
+	repb "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+	"google.golang.org/protobuf/proto"
+)
+
+// ErrNotCached is returned by a CacheBackend for a missing action or blob
+var ErrNotCached = errors.New("not cached")
+
+// CacheBackend is a cache shared between machines, it's checked when an action
+// isn't in the local cache. It follows the Remote Execution API's ActionCache
+// and ContentAddressableStorage services: action results are keyed by action
+// key and blobs by their digest.
+type CacheBackend interface {
+	GetActionResult(ctx context.Context, key string) (*repb.ActionResult, error)
+	UpdateActionResult(ctx context.Context, key string, result *repb.ActionResult) error
+	// FindMissingBlobs returns the digests that aren't in the cache
+	FindMissingBlobs(ctx context.Context, digests []Digest) ([]Digest, error)
+	GetBlob(ctx context.Context, digest Digest) (io.ReadCloser, error)
+	PutBlob(ctx context.Context, digest Digest, r io.Reader) error
+}
+
+// NewRemoteCache connects to the remote cache at rawURL, an http(s):// URL for
+// a cache speaking bazel-remote's HTTP protocol, like `yabs cache serve`, or a
+// grpc(s):// URL for one speaking the Remote Execution API
+func NewRemoteCache(rawURL, instance string) (CacheBackend, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("parsing remote cache url: %w", err)
+	}
+	switch u.Scheme {
+	case "http", "https":
+		return NewHTTPCache(rawURL), nil
+	case "grpc", "grpcs":
+		return NewGRPCCache(u.Host, instance, u.Scheme == "grpcs")
+	}
+	return nil, fmt.Errorf("unsupported remote cache scheme %q", u.Scheme)
+}
+
+// isDigest reports whether s looks like a hex encoded sha256
+func isDigest(s string) bool {
+	if len(s) != sha256.Size*2 {
+		return false
+	}
+	_, err := hex.DecodeString(s)
+	return err == nil
+}
+
+// DiskCache is a CacheBackend stored in a directory, it's what `yabs cache
+// serve` serves
+type DiskCache struct {
+	Dir string
+}
+
+func NewDiskCache(dir string) *DiskCache {
+	return &DiskCache{Dir: dir}
+}
+
+func (d *DiskCache) loc(kind, hash string) (string, error) {
+	if !isDigest(hash) {
+		return "", fmt.Errorf("invalid digest %q", hash)
+	}
+	return filepath.Join(d.Dir, kind, hash[:2], hash[2:]), nil
+}
+
+func (d *DiskCache) get(kind, hash string) (*os.File, error) {
+	loc, err := d.loc(kind, hash)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(loc)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, ErrNotCached
+	}
+	return f, err
+}
+
+func (d *DiskCache) GetActionResult(ctx context.Context, key string) (*repb.ActionResult, error) {
+	f, err := d.get("ac", key)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	bs, err := io.ReadAll(f)
+	if err != nil {
+		return nil, err
+	}
+	result := &repb.ActionResult{}
+	if err := proto.Unmarshal(bs, result); err != nil {
+		return nil, fmt.Errorf("reading action result: %w", err)
+	}
+	return result, nil
+}
+
+func (d *DiskCache) UpdateActionResult(ctx context.Context, key string, result *repb.ActionResult) error {
+	loc, err := d.loc("ac", key)
+	if err != nil {
+		return err
+	}
+	bs, err := proto.Marshal(result)
+	if err != nil {
+		return err
+	}
+	return writeAtomic(loc, 0o644, func(w io.Writer) error {
+		_, err := w.Write(bs)
+		return err
+	})
+}
+
+func (d *DiskCache) FindMissingBlobs(ctx context.Context, digests []Digest) ([]Digest, error) {
+	missing := []Digest{}
+	for _, digest := range digests {
+		loc, err := d.loc("cas", digest.Hash)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := os.Stat(loc); errors.Is(err, fs.ErrNotExist) {
+			missing = append(missing, digest)
+		} else if err != nil {
+			return nil, err
+		}
+	}
+	return missing, nil
+}
+
+func (d *DiskCache) GetBlob(ctx context.Context, digest Digest) (io.ReadCloser, error) {
+	return d.get("cas", digest.Hash)
+}
+
+// PutBlob stores the blob if its contents match digest's hash
+func (d *DiskCache) PutBlob(ctx context.Context, digest Digest, r io.Reader) error {
+	loc, err := d.loc("cas", digest.Hash)
+	if err != nil {
+		return err
+	}
+	return writeAtomic(loc, 0o444, func(w io.Writer) error {
+		h := sha256.New()
+		if _, err := io.Copy(io.MultiWriter(w, h), r); err != nil {
+			return err
+		}
+		if got := hex.EncodeToString(h.Sum(nil)); got != digest.Hash {
+			return fmt.Errorf("blob digest mismatch: want %s, got %s", digest.Hash, got)
+		}
+		return nil
+	})
+}
+
+// fetchAction looks for an action in the remote cache, copying its output
+// into the local cache if it's there
+func (y *Yabs) fetchAction(ctx context.Context, key string) (actionResult, bool) {
+	res := actionResult{}
+	result, checksum, ok := y.remoteAction(ctx, key)
+	if !ok {
+		return res, false
+	}
+	if checksum != "" {
+		if err := y.fetchOut(ctx, checksum, result); err != nil {
+			log.Printf("remote cache: action %s: %s", key, err)
+			return res, false
+		}
+	}
+	res.Checksum = checksum
+	if err := y.saveAction(key, res); err != nil {
+		log.Printf("remote cache: action %s: %s", key, err)
+		return res, false
+	}
+	res.Remote = true
+	return res, true
+}
+
+// remoteAction looks for an action in the remote cache without fetching its
+// output, returning the result along with the output's checksum
+func (y *Yabs) remoteAction(ctx context.Context, key string) (*repb.ActionResult, string, bool) {
+	if y.Remote == nil {
+		return nil, "", false
+	}
+	result, err := y.Remote.GetActionResult(ctx, key)
+	if err != nil {
+		if !errors.Is(err, ErrNotCached) {
+			log.Printf("remote cache: %s", err)
+		}
+		return nil, "", false
+	}
+	checksum, ok := resultChecksum(result)
+	if !ok {
+		// not stored by yabs, the output's checksum isn't known
+		return nil, "", false
+	}
+	return result, checksum, true
+}
+
+// fetchOut copies an action's output from the remote cache into the local
+// cache, blobs that are already cached locally aren't fetched
+func (y *Yabs) fetchOut(ctx context.Context, checksum string, result *repb.ActionResult) error {
+	if !isDigest(checksum) {
+		return fmt.Errorf("invalid checksum %q", checksum)
+	}
+	// a cached tree is never replaced by one from the remote
+	if _, err := os.Stat(y.getCacheLoc(checksum)); err == nil {
+		return nil
+	}
+	tr := tree{}
+	blobs := []Digest{}
+	switch {
+	case len(result.OutputFiles) == 1 && result.OutputFiles[0].Path == outPath:
+		f := result.OutputFiles[0]
+		digest, err := digestFromProto(f.Digest)
+		if err != nil {
+			return err
+		}
+		blobs = append(blobs, digest)
+		tr.Entries = []treeEntry{{Path: ".", Mode: filePerm(f.NodeProperties, f.IsExecutable), Digest: digest.Hash}}
+	case len(result.OutputSymlinks) == 1 && result.OutputSymlinks[0].Path == outPath:
+		tr.Entries = []treeEntry{{Path: ".", Mode: fs.ModeSymlink | 0o777, Link: result.OutputSymlinks[0].Target}}
+	case len(result.OutputDirectories) == 1 && result.OutputDirectories[0].Path == outPath:
+		digest, err := digestFromProto(result.OutputDirectories[0].TreeDigest)
+		if err != nil {
+			return err
+		}
+		bs, err := y.readRemoteBlob(ctx, digest)
+		if err != nil {
+			return fmt.Errorf("fetching tree: %w", err)
+		}
+		treeMsg := &repb.Tree{}
+		if err := proto.Unmarshal(bs, treeMsg); err != nil {
+			return fmt.Errorf("reading tree: %w", err)
+		}
+		if tr, blobs, err = decodeTree(treeMsg); err != nil {
+			return fmt.Errorf("reading tree: %w", err)
+		}
+	default:
+		return fmt.Errorf("action result doesn't have a single output at %q", outPath)
+	}
+
+	// the checksum is only the remote's claim, so a poisoned result can't be
+	// stored as another output
+	if sum, ok, err := treeChecksum(tr); err != nil {
+		return fmt.Errorf("reading tree: %w", err)
+	} else if !ok || sum != checksum {
+		return fmt.Errorf("tree doesn't match checksum %s", checksum)
+	}
+
+	fetched := map[string]bool{}
+	for _, digest := range blobs {
+		if fetched[digest.Hash] {
+			continue
+		}
+		fetched[digest.Hash] = true
+		if _, err := os.Stat(y.getBlobLoc(digest.Hash)); err == nil {
+			continue
+		}
+		if err := y.fetchBlob(ctx, digest, tr); err != nil {
+			return err
+		}
+	}
+	return writeAtomic(y.getCacheLoc(checksum), 0o444, func(w io.Writer) error {
+		return json.NewEncoder(w).Encode(tr)
+	})
+}
+
+// fetchBlob copies a blob from the remote cache into the local cache
+func (y *Yabs) fetchBlob(ctx context.Context, digest Digest, tr tree) error {
+	mode := fs.FileMode(0o444)
+	for _, entry := range tr.Entries {
+		if entry.Digest == digest.Hash {
+			mode = entry.Mode
+			break
+		}
+	}
+	rc, err := y.Remote.GetBlob(ctx, digest)
+	if err != nil {
+		return fmt.Errorf("fetching blob %s: %w", digest, err)
+	}
+	defer rc.Close()
+	got, err := y.writeBlob(rc, mode)
+	if err != nil {
+		return err
+	}
+	if got != digest.Hash {
+		return fmt.Errorf("blob digest mismatch: want %s, got %s", digest.Hash, got)
+	}
+	return nil
+}
+
+// readRemoteBlob reads a blob from the remote cache, checking its digest
+func (y *Yabs) readRemoteBlob(ctx context.Context, digest Digest) ([]byte, error) {
+	rc, err := y.Remote.GetBlob(ctx, digest)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	bs, err := io.ReadAll(io.LimitReader(rc, digest.Size+1))
+	if err != nil {
+		return nil, err
+	}
+	if got := digestBytes(bs); got != digest {
+		return nil, fmt.Errorf("blob digest mismatch: want %s, got %s", digest, got)
+	}
+	return bs, nil
+}
+
+// uploadAction copies an action's output, then the action, to the remote cache
+func (y *Yabs) uploadAction(ctx context.Context, key string, res actionResult) error {
+	rr, err := y.encodeAction(res)
+	if err != nil {
+		return err
+	}
+	digests := rr.blobs
+	if rr.tree != nil {
+		digests = append(digests, rr.treeDigest)
+	}
+	missing, err := y.Remote.FindMissingBlobs(ctx, digests)
+	if err != nil {
+		return fmt.Errorf("finding missing blobs: %w", err)
+	}
+	for _, digest := range missing {
+		if rr.tree != nil && digest == rr.treeDigest {
+			err = y.Remote.PutBlob(ctx, digest, bytes.NewReader(rr.tree))
+		} else {
+			err = y.uploadBlob(ctx, digest)
+		}
+		if err != nil {
+			return fmt.Errorf("uploading blob %s: %w", digest, err)
+		}
+	}
+	return y.Remote.UpdateActionResult(ctx, key, rr.result)
+}
+
+// uploadMissingAction uploads an action that was cached locally, unless the
+// remote cache already has it
+func (y *Yabs) uploadMissingAction(ctx context.Context, key string, res actionResult) error {
+	_, err := y.Remote.GetActionResult(ctx, key)
+	if err == nil {
+		return nil
+	}
+	if !errors.Is(err, ErrNotCached) {
+		return fmt.Errorf("getting action: %w", err)
+	}
+	return y.uploadAction(ctx, key, res)
+}
+
+func (y *Yabs) uploadBlob(ctx context.Context, digest Digest) error {
+	f, err := os.Open(y.getBlobLoc(digest.Hash))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return y.Remote.PutBlob(ctx, digest, f)
+}
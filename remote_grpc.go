@@ -0,0 +1,260 @@
+package yabs
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+
+	repb "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+	"google.golang.org/genproto/googleapis/bytestream"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+)
+
+// defaultMaxBatchSize is the largest blob sent in a batch request, bigger
+// blobs are streamed with ByteStream. gRPC's default message limit is 4MiB.
+const defaultMaxBatchSize = 1 << 20
+
+// byteStreamChunk is the size of the chunks blobs are uploaded in
+const byteStreamChunk = 64 << 10
+
+// GRPCCache is a CacheBackend talking to a cache with the Remote Execution
+// API's ActionCache, ContentAddressableStorage and ByteStream services, like
+// bazel-remote or Buildbarn
+type GRPCCache struct {
+	// Instance is the instance name sent with every request
+	Instance string
+	// MaxBatchSize is the size of the largest blob read or written in a batch
+	// request, bigger blobs are streamed
+	MaxBatchSize int64
+
+	conn *grpc.ClientConn
+	ac   repb.ActionCacheClient
+	cas  repb.ContentAddressableStorageClient
+	bs   bytestream.ByteStreamClient
+}
+
+// NewGRPCCache connects to the cache at target, a host:port
+func NewGRPCCache(target, instance string, useTLS bool, opts ...grpc.DialOption) (*GRPCCache, error) {
+	creds := insecure.NewCredentials()
+	if useTLS {
+		creds = credentials.NewTLS(&tls.Config{})
+	}
+	opts = append([]grpc.DialOption{grpc.WithTransportCredentials(creds)}, opts...)
+	conn, err := grpc.Dial(target, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("connecting to remote cache: %w", err)
+	}
+	return &GRPCCache{
+		Instance:     instance,
+		MaxBatchSize: defaultMaxBatchSize,
+		conn:         conn,
+		ac:           repb.NewActionCacheClient(conn),
+		cas:          repb.NewContentAddressableStorageClient(conn),
+		bs:           bytestream.NewByteStreamClient(conn),
+	}, nil
+}
+
+func (c *GRPCCache) Close() error {
+	return c.conn.Close()
+}
+
+// actionDigest is the digest an action key is stored under. yabs' action keys
+// aren't digests of REAPI Actions, so their size is left out.
+func actionDigest(key string) *repb.Digest {
+	return &repb.Digest{Hash: key}
+}
+
+// grpcError turns a NotFound status into ErrNotCached
+func grpcError(err error) error {
+	if status.Code(err) == codes.NotFound {
+		return ErrNotCached
+	}
+	return err
+}
+
+func (c *GRPCCache) GetActionResult(ctx context.Context, key string) (*repb.ActionResult, error) {
+	result, err := c.ac.GetActionResult(ctx, &repb.GetActionResultRequest{
+		InstanceName: c.Instance,
+		ActionDigest: actionDigest(key),
+	})
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	return result, nil
+}
+
+func (c *GRPCCache) UpdateActionResult(ctx context.Context, key string, result *repb.ActionResult) error {
+	_, err := c.ac.UpdateActionResult(ctx, &repb.UpdateActionResultRequest{
+		InstanceName: c.Instance,
+		ActionDigest: actionDigest(key),
+		ActionResult: result,
+	})
+	return err
+}
+
+func (c *GRPCCache) FindMissingBlobs(ctx context.Context, digests []Digest) ([]Digest, error) {
+	req := &repb.FindMissingBlobsRequest{InstanceName: c.Instance}
+	for _, digest := range digests {
+		req.BlobDigests = append(req.BlobDigests, digest.proto())
+	}
+	resp, err := c.cas.FindMissingBlobs(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	missing := []Digest{}
+	for _, d := range resp.MissingBlobDigests {
+		digest, err := digestFromProto(d)
+		if err != nil {
+			return nil, err
+		}
+		missing = append(missing, digest)
+	}
+	return missing, nil
+}
+
+// resourceName is a ByteStream resource name, prefixed with the instance
+func (c *GRPCCache) resourceName(format string, args ...any) string {
+	name := fmt.Sprintf(format, args...)
+	if c.Instance != "" {
+		name = c.Instance + "/" + name
+	}
+	return name
+}
+
+func (c *GRPCCache) GetBlob(ctx context.Context, digest Digest) (io.ReadCloser, error) {
+	if digest.Size <= c.MaxBatchSize {
+		resp, err := c.cas.BatchReadBlobs(ctx, &repb.BatchReadBlobsRequest{
+			InstanceName: c.Instance,
+			Digests:      []*repb.Digest{digest.proto()},
+		})
+		if err != nil {
+			return nil, err
+		}
+		if len(resp.Responses) != 1 {
+			return nil, fmt.Errorf("reading blob %s: got %d responses", digest, len(resp.Responses))
+		}
+		if err := status.ErrorProto(resp.Responses[0].Status); err != nil {
+			return nil, grpcError(err)
+		}
+		return io.NopCloser(bytes.NewReader(resp.Responses[0].Data)), nil
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	stream, err := c.bs.Read(ctx, &bytestream.ReadRequest{
+		ResourceName: c.resourceName("blobs/%s/%d", digest.Hash, digest.Size),
+	})
+	if err != nil {
+		cancel()
+		return nil, grpcError(err)
+	}
+	return &byteStreamReader{stream: stream, cancel: cancel}, nil
+}
+
+// byteStreamReader reads a blob from a ByteStream Read call
+type byteStreamReader struct {
+	stream bytestream.ByteStream_ReadClient
+	cancel context.CancelFunc
+	buf    []byte
+}
+
+func (r *byteStreamReader) Read(p []byte) (int, error) {
+	for len(r.buf) == 0 {
+		resp, err := r.stream.Recv()
+		if errors.Is(err, io.EOF) {
+			return 0, io.EOF
+		} else if err != nil {
+			return 0, grpcError(err)
+		}
+		r.buf = resp.Data
+	}
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
+
+func (r *byteStreamReader) Close() error {
+	r.cancel()
+	return nil
+}
+
+func (c *GRPCCache) PutBlob(ctx context.Context, digest Digest, r io.Reader) error {
+	if digest.Size <= c.MaxBatchSize {
+		data, err := io.ReadAll(r)
+		if err != nil {
+			return err
+		}
+		resp, err := c.cas.BatchUpdateBlobs(ctx, &repb.BatchUpdateBlobsRequest{
+			InstanceName: c.Instance,
+			Requests:     []*repb.BatchUpdateBlobsRequest_Request{{Digest: digest.proto(), Data: data}},
+		})
+		if err != nil {
+			return err
+		}
+		if len(resp.Responses) != 1 {
+			return fmt.Errorf("writing blob %s: got %d responses", digest, len(resp.Responses))
+		}
+		return status.ErrorProto(resp.Responses[0].Status)
+	}
+
+	uuid := make([]byte, 16)
+	if _, err := rand.Read(uuid); err != nil {
+		return err
+	}
+	name := c.resourceName("uploads/%s/blobs/%s/%d", hex.EncodeToString(uuid), digest.Hash, digest.Size)
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	stream, err := c.bs.Write(ctx)
+	if err != nil {
+		return err
+	}
+	buf := make([]byte, byteStreamChunk)
+	var offset int64
+	for {
+		n, err := io.ReadFull(r, buf)
+		if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+			return err
+		}
+		req := &bytestream.WriteRequest{
+			WriteOffset: offset,
+			Data:        buf[:n],
+			FinishWrite: offset+int64(n) >= digest.Size,
+		}
+		if offset == 0 {
+			req.ResourceName = name
+		}
+		if sendErr := stream.Send(req); sendErr != nil {
+			// the server ends the stream early when it already has the blob,
+			// the reason is returned by CloseAndRecv
+			if errors.Is(sendErr, io.EOF) {
+				break
+			}
+			return sendErr
+		}
+		offset += int64(n)
+		if req.FinishWrite {
+			break
+		}
+		if n == 0 {
+			return fmt.Errorf("writing blob %s: only read %d bytes", digest, offset)
+		}
+	}
+	resp, err := stream.CloseAndRecv()
+	if err != nil {
+		return err
+	}
+	// -1 is returned by newer servers when they already have the blob
+	if resp.CommittedSize != digest.Size && resp.CommittedSize != -1 {
+		return fmt.Errorf("writing blob %s: committed %d bytes", digest, resp.CommittedSize)
+	}
+	return nil
+}
@@ -0,0 +1,253 @@
+package yabs
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	repb "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+	"google.golang.org/genproto/googleapis/bytestream"
+	"google.golang.org/genproto/googleapis/rpc/status"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	grpcstatus "google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+// fakeCAS is an in memory ActionCache, ContentAddressableStorage and
+// ByteStream server
+type fakeCAS struct {
+	repb.UnimplementedActionCacheServer
+	repb.UnimplementedContentAddressableStorageServer
+	bytestream.UnimplementedByteStreamServer
+
+	mu        sync.Mutex
+	instances map[string]bool
+	actions   map[string][]byte
+	blobs     map[string][]byte
+	streamed  int
+}
+
+func newFakeCAS(t *testing.T) (*fakeCAS, string) {
+	t.Helper()
+	cas := &fakeCAS{instances: map[string]bool{}, actions: map[string][]byte{}, blobs: map[string][]byte{}}
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := grpc.NewServer()
+	repb.RegisterActionCacheServer(server, cas)
+	repb.RegisterContentAddressableStorageServer(server, cas)
+	bytestream.RegisterByteStreamServer(server, cas)
+	go func() { _ = server.Serve(lis) }()
+	t.Cleanup(server.Stop)
+	return cas, lis.Addr().String()
+}
+
+func (f *fakeCAS) GetActionResult(ctx context.Context, req *repb.GetActionResultRequest) (*repb.ActionResult, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.instances[req.InstanceName] = true
+	bs, ok := f.actions[req.ActionDigest.Hash]
+	if !ok {
+		return nil, grpcstatus.Error(codes.NotFound, "not found")
+	}
+	result := &repb.ActionResult{}
+	return result, proto.Unmarshal(bs, result)
+}
+
+func (f *fakeCAS) UpdateActionResult(ctx context.Context, req *repb.UpdateActionResultRequest) (*repb.ActionResult, error) {
+	bs, err := proto.Marshal(req.ActionResult)
+	if err != nil {
+		return nil, err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.instances[req.InstanceName] = true
+	f.actions[req.ActionDigest.Hash] = bs
+	return req.ActionResult, nil
+}
+
+func (f *fakeCAS) FindMissingBlobs(ctx context.Context, req *repb.FindMissingBlobsRequest) (*repb.FindMissingBlobsResponse, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	resp := &repb.FindMissingBlobsResponse{}
+	for _, digest := range req.BlobDigests {
+		if _, ok := f.blobs[digest.Hash]; !ok {
+			resp.MissingBlobDigests = append(resp.MissingBlobDigests, digest)
+		}
+	}
+	return resp, nil
+}
+
+func (f *fakeCAS) put(digest *repb.Digest, data []byte) *status.Status {
+	if got := digestBytes(data); got.Hash != digest.Hash || got.Size != digest.SizeBytes {
+		return &status.Status{Code: int32(codes.InvalidArgument), Message: "digest mismatch"}
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.blobs[digest.Hash] = data
+	return &status.Status{}
+}
+
+func (f *fakeCAS) BatchUpdateBlobs(ctx context.Context, req *repb.BatchUpdateBlobsRequest) (*repb.BatchUpdateBlobsResponse, error) {
+	resp := &repb.BatchUpdateBlobsResponse{}
+	for _, r := range req.Requests {
+		resp.Responses = append(resp.Responses, &repb.BatchUpdateBlobsResponse_Response{Digest: r.Digest, Status: f.put(r.Digest, r.Data)})
+	}
+	return resp, nil
+}
+
+func (f *fakeCAS) BatchReadBlobs(ctx context.Context, req *repb.BatchReadBlobsRequest) (*repb.BatchReadBlobsResponse, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	resp := &repb.BatchReadBlobsResponse{}
+	for _, digest := range req.Digests {
+		r := &repb.BatchReadBlobsResponse_Response{Digest: digest, Status: &status.Status{}}
+		if data, ok := f.blobs[digest.Hash]; ok {
+			r.Data = data
+		} else {
+			r.Status.Code = int32(codes.NotFound)
+		}
+		resp.Responses = append(resp.Responses, r)
+	}
+	return resp, nil
+}
+
+// blobHash is the hash in a resource name, after "blobs/"
+func blobHash(name string) string {
+	_, rest, _ := strings.Cut(name, "blobs/")
+	hash, _, _ := strings.Cut(rest, "/")
+	return hash
+}
+
+func (f *fakeCAS) Read(req *bytestream.ReadRequest, stream bytestream.ByteStream_ReadServer) error {
+	f.mu.Lock()
+	data, ok := f.blobs[blobHash(req.ResourceName)]
+	f.streamed++
+	f.mu.Unlock()
+	if !ok {
+		return grpcstatus.Error(codes.NotFound, "not found")
+	}
+	for len(data) > 0 {
+		n := 3
+		if n > len(data) {
+			n = len(data)
+		}
+		if err := stream.Send(&bytestream.ReadResponse{Data: data[:n]}); err != nil {
+			return err
+		}
+		data = data[n:]
+	}
+	return nil
+}
+
+func (f *fakeCAS) Write(stream bytestream.ByteStream_WriteServer) error {
+	name := ""
+	buf := bytes.Buffer{}
+	for {
+		req, err := stream.Recv()
+		if errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			return err
+		}
+		if req.ResourceName != "" {
+			name = req.ResourceName
+		}
+		if req.WriteOffset != int64(buf.Len()) {
+			return grpcstatus.Error(codes.InvalidArgument, "bad offset")
+		}
+		buf.Write(req.Data)
+		if req.FinishWrite {
+			break
+		}
+	}
+	data := buf.Bytes()
+	if st := f.put(&repb.Digest{Hash: blobHash(name), SizeBytes: int64(len(data))}, data); st.Code != 0 {
+		return grpcstatus.ErrorProto(st)
+	}
+	f.mu.Lock()
+	f.streamed++
+	f.mu.Unlock()
+	return stream.SendAndClose(&bytestream.WriteResponse{CommittedSize: int64(len(data))})
+}
+
+func TestGRPCRemoteCache(t *testing.T) {
+	chdirTemp(t)
+	cas, addr := newFakeCAS(t)
+
+	runs := 0
+	restored := ""
+	build := func(cacheDir string, upload bool) {
+		remote, err := NewGRPCCache(addr, "main", false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer remote.Close()
+		// small enough that the bigger file is streamed
+		remote.MaxBatchSize = 8
+
+		y := New()
+		y.CacheDir = cacheDir
+		y.Remote = remote
+		y.RemoteUpload = upload
+		y.Register("gen", []string{}, func(bc BuildCtx) error {
+			runs++
+			if err := os.MkdirAll(filepath.Join(bc.Out, "sub", "empty"), os.ModePerm); err != nil {
+				return err
+			}
+			if err := os.WriteFile(filepath.Join(bc.Out, "sub", "a"), []byte("hi"), 0o644); err != nil {
+				return err
+			}
+			if err := os.WriteFile(filepath.Join(bc.Out, "tool"), []byte("#!/bin/sh\necho hello"), 0o755); err != nil {
+				return err
+			}
+			return os.Symlink("sub/a", filepath.Join(bc.Out, "link"))
+		})
+		y.Register("default", []string{"gen"}, func(bc BuildCtx) error {
+			restored = bc.GetDep("gen")
+			return nil
+		}, WithAlwaysRun())
+		if err := y.ExecWithDefault("default"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	build("a", true)
+	if err := os.RemoveAll(".yabs"); err != nil {
+		t.Fatal(err)
+	}
+	build("b", false)
+
+	if runs != 1 {
+		t.Fatalf("want \"gen\" to be fetched from the remote cache, ran %d times", runs)
+	}
+	if cas.streamed == 0 {
+		t.Fatal("want blobs bigger than MaxBatchSize to be streamed")
+	}
+	if len(cas.instances) != 1 || !cas.instances["main"] {
+		t.Fatalf("want requests for instance \"main\", got %v", cas.instances)
+	}
+	bs, err := os.ReadFile(filepath.Join(restored, "link"))
+	if err != nil || string(bs) != "hi" {
+		t.Fatalf("want link to read %q, got=%q err=%v", "hi", bs, err)
+	}
+	st, err := os.Stat(filepath.Join(restored, "tool"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.Mode()&0o111 == 0 {
+		t.Fatalf("want tool to stay executable, got mode %s", st.Mode())
+	}
+	if _, err := os.Stat(filepath.Join(restored, "sub", "empty")); err != nil {
+		t.Fatalf("want empty dir to be restored: %s", err)
+	}
+}
@@ -0,0 +1,213 @@
+package yabs
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+
+	repb "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+	"google.golang.org/protobuf/proto"
+)
+
+// HTTPCache is a CacheBackend talking to a cache server with bazel-remote's
+// HTTP protocol, like the one run by `yabs cache serve`:
+//
+//	GET/PUT /ac/<key>          ActionResult protos
+//	GET/HEAD/PUT /cas/<sha256> blobs
+//
+// A missing entry is a 404.
+type HTTPCache struct {
+	// URL of the server, e.g. http://cache.local:8080
+	URL    string
+	Client *http.Client
+}
+
+func NewHTTPCache(url string) *HTTPCache {
+	return &HTTPCache{URL: strings.TrimSuffix(url, "/"), Client: http.DefaultClient}
+}
+
+func (c *HTTPCache) do(ctx context.Context, method, path string, body io.Reader) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, c.URL+path, body)
+	if err != nil {
+		return nil, err
+	}
+	return c.send(req)
+}
+
+func (c *HTTPCache) send(req *http.Request) (*http.Response, error) {
+	method, path := req.Method, req.URL.Path
+	resp, err := c.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		resp.Body.Close()
+		return nil, ErrNotCached
+	case resp.StatusCode >= 300:
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		resp.Body.Close()
+		return nil, fmt.Errorf("%s %s: %s: %s", method, path, resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return resp, nil
+}
+
+func (c *HTTPCache) put(ctx context.Context, path string, body io.Reader, size int64) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, c.URL+path, body)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = size
+	resp, err := c.send(req)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+func (c *HTTPCache) GetActionResult(ctx context.Context, key string) (*repb.ActionResult, error) {
+	resp, err := c.do(ctx, http.MethodGet, "/ac/"+key, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	bs, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	result := &repb.ActionResult{}
+	if err := proto.Unmarshal(bs, result); err != nil {
+		return nil, fmt.Errorf("reading action result: %w", err)
+	}
+	return result, nil
+}
+
+func (c *HTTPCache) UpdateActionResult(ctx context.Context, key string, result *repb.ActionResult) error {
+	bs, err := proto.Marshal(result)
+	if err != nil {
+		return err
+	}
+	return c.put(ctx, "/ac/"+key, bytes.NewReader(bs), int64(len(bs)))
+}
+
+func (c *HTTPCache) FindMissingBlobs(ctx context.Context, digests []Digest) ([]Digest, error) {
+	missing := []Digest{}
+	for _, digest := range digests {
+		resp, err := c.do(ctx, http.MethodHead, "/cas/"+digest.Hash, nil)
+		if errors.Is(err, ErrNotCached) {
+			missing = append(missing, digest)
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		resp.Body.Close()
+	}
+	return missing, nil
+}
+
+func (c *HTTPCache) GetBlob(ctx context.Context, digest Digest) (io.ReadCloser, error) {
+	resp, err := c.do(ctx, http.MethodGet, "/cas/"+digest.Hash, nil)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+func (c *HTTPCache) PutBlob(ctx context.Context, digest Digest, r io.Reader) error {
+	return c.put(ctx, "/cas/"+digest.Hash, r, digest.Size)
+}
+
+// CacheHandler serves a CacheBackend with the protocol HTTPCache speaks
+func CacheHandler(backend CacheBackend) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/ac/", func(w http.ResponseWriter, r *http.Request) {
+		key := strings.TrimPrefix(r.URL.Path, "/ac/")
+		if !isDigest(key) {
+			http.Error(w, "invalid action key", http.StatusBadRequest)
+			return
+		}
+		switch r.Method {
+		case http.MethodGet:
+			result, err := backend.GetActionResult(r.Context(), key)
+			if err != nil {
+				cacheError(w, err)
+				return
+			}
+			bs, err := proto.Marshal(result)
+			if err != nil {
+				cacheError(w, err)
+				return
+			}
+			_, _ = w.Write(bs)
+		case http.MethodPut:
+			bs, err := io.ReadAll(r.Body)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			result := &repb.ActionResult{}
+			if err := proto.Unmarshal(bs, result); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if err := backend.UpdateActionResult(r.Context(), key, result); err != nil {
+				cacheError(w, err)
+				return
+			}
+			w.WriteHeader(http.StatusCreated)
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+	mux.HandleFunc("/cas/", func(w http.ResponseWriter, r *http.Request) {
+		hash := strings.TrimPrefix(r.URL.Path, "/cas/")
+		if !isDigest(hash) {
+			http.Error(w, "invalid digest", http.StatusBadRequest)
+			return
+		}
+		// the size isn't in the url, a blob's size is only known when it's put
+		digest := Digest{Hash: hash, Size: r.ContentLength}
+		switch r.Method {
+		case http.MethodGet:
+			rc, err := backend.GetBlob(r.Context(), digest)
+			if err != nil {
+				cacheError(w, err)
+				return
+			}
+			defer rc.Close()
+			_, _ = io.Copy(w, rc)
+		case http.MethodHead:
+			missing, err := backend.FindMissingBlobs(r.Context(), []Digest{digest})
+			if err != nil {
+				cacheError(w, err)
+				return
+			}
+			if len(missing) > 0 {
+				w.WriteHeader(http.StatusNotFound)
+			}
+		case http.MethodPut:
+			if err := backend.PutBlob(r.Context(), digest, r.Body); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			w.WriteHeader(http.StatusCreated)
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+	return mux
+}
+
+func cacheError(w http.ResponseWriter, err error) {
+	if errors.Is(err, ErrNotCached) {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	log.Printf("cache: %s", err)
+	http.Error(w, err.Error(), http.StatusInternalServerError)
+}
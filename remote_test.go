@@ -0,0 +1,241 @@
+package yabs
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	repb "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+	"golang.org/x/exp/slices"
+)
+
+func TestRemoteCache(t *testing.T) {
+	chdirTemp(t)
+	server := httptest.NewServer(CacheHandler(NewDiskCache("remote")))
+	defer server.Close()
+
+	runs := 0
+	restored := ""
+	build := func(cacheDir string, upload bool) {
+		y := New()
+		y.CacheDir = cacheDir
+		y.Remote = NewHTTPCache(server.URL)
+		y.RemoteUpload = upload
+		y.Register("gen", []string{}, func(bc BuildCtx) error {
+			runs++
+			if err := os.MkdirAll(bc.Out, os.ModePerm); err != nil {
+				return err
+			}
+			return os.WriteFile(filepath.Join(bc.Out, "tool"), []byte("#!/bin/sh"), 0o755)
+		})
+		y.Register("default", []string{"gen"}, func(bc BuildCtx) error {
+			restored = bc.GetDep("gen")
+			return nil
+		}, WithAlwaysRun())
+		if err := y.ExecWithDefault("default"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	build("a", true)
+	// another machine, with nothing cached locally
+	if err := os.RemoveAll(".yabs"); err != nil {
+		t.Fatal(err)
+	}
+	build("b", false)
+
+	if runs != 1 {
+		t.Fatalf("want \"gen\" to be fetched from the remote cache, ran %d times", runs)
+	}
+	bs, err := os.ReadFile(filepath.Join(restored, "tool"))
+	if err != nil || string(bs) != "#!/bin/sh" {
+		t.Fatalf("want tool to read %q, got=%q err=%v", "#!/bin/sh", bs, err)
+	}
+	st, err := os.Stat(filepath.Join(restored, "tool"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.Mode()&0o111 == 0 {
+		t.Fatalf("want tool to stay executable, got mode %s", st.Mode())
+	}
+}
+
+// countingCache counts the actions uploaded to a cache
+type countingCache struct {
+	CacheBackend
+	updates int
+}
+
+func (c *countingCache) UpdateActionResult(ctx context.Context, key string, result *repb.ActionResult) error {
+	c.updates++
+	return c.CacheBackend.UpdateActionResult(ctx, key, result)
+}
+
+func TestRemoteUploadsLocalHits(t *testing.T) {
+	chdirTemp(t)
+	server := httptest.NewServer(CacheHandler(NewDiskCache("remote")))
+	defer server.Close()
+	remote := &countingCache{CacheBackend: NewHTTPCache(server.URL)}
+
+	runs := 0
+	build := func(cacheDir string, upload bool) {
+		y := New()
+		y.CacheDir = cacheDir
+		y.Remote = remote
+		y.RemoteUpload = upload
+		y.Register("gen", []string{}, func(bc BuildCtx) error {
+			runs++
+			return os.WriteFile(bc.Out, []byte("hi"), 0o644)
+		})
+		if err := y.ExecWithDefault("gen"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	build("a", false)
+	// "gen" is cached locally, only the remote cache is missing it
+	build("a", true)
+	if remote.updates != 1 {
+		t.Fatalf("want the local hit uploaded once, got %d uploads", remote.updates)
+	}
+	build("a", true)
+	if remote.updates != 1 {
+		t.Fatalf("want a local hit the remote already has left alone, got %d uploads", remote.updates)
+	}
+	// another machine, with nothing cached locally
+	if err := os.RemoveAll(".yabs"); err != nil {
+		t.Fatal(err)
+	}
+	build("b", true)
+	if runs != 1 {
+		t.Fatalf("want \"gen\" to be fetched from the remote cache, ran %d times", runs)
+	}
+	if remote.updates != 1 {
+		t.Fatalf("want a result fetched from the remote left alone, got %d uploads", remote.updates)
+	}
+}
+
+func TestDryRunDoesntFetchFromRemote(t *testing.T) {
+	chdirTemp(t)
+	server := httptest.NewServer(CacheHandler(NewDiskCache("remote")))
+	defer server.Close()
+
+	register := func(y *Yabs) {
+		y.Remote = NewHTTPCache(server.URL)
+		y.Register("gen", []string{}, func(bc BuildCtx) error {
+			return os.WriteFile(bc.Out, []byte("hi"), 0o644)
+		})
+	}
+	y := New()
+	y.CacheDir = "a"
+	y.RemoteUpload = true
+	register(y)
+	if err := y.ExecWithDefault("gen"); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.RemoveAll(".yabs"); err != nil {
+		t.Fatal(err)
+	}
+
+	y = New()
+	y.CacheDir = "b"
+	register(y)
+	plan, err := y.DryRun([]string{"gen"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []PlannedTask{{Target: "gen", Reason: Reason{Kind: RemoteCached}}}
+	if !slices.Equal(plan, want) {
+		t.Fatalf("want plan=%+v, got=%+v", want, plan)
+	}
+	for _, dir := range []string{"actions", "trees", "blobs"} {
+		files, err := y.listCache(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(files) != 0 {
+			t.Fatalf("want nothing fetched into the cache's %s, got %d files", dir, len(files))
+		}
+	}
+}
+
+func TestRemoteCacheRejectsBadBlob(t *testing.T) {
+	server := httptest.NewServer(CacheHandler(NewDiskCache(t.TempDir())))
+	defer server.Close()
+	cache := NewHTTPCache(server.URL)
+	digest := digestBytes([]byte("hello"))
+
+	if err := cache.PutBlob(context.Background(), digest, strings.NewReader("goodbye")); err == nil {
+		t.Fatal("want a blob not matching its digest to be rejected")
+	}
+	if missing, err := cache.FindMissingBlobs(context.Background(), []Digest{digest}); err != nil || len(missing) != 1 {
+		t.Fatalf("want the blob to be missing, got missing=%v err=%v", missing, err)
+	}
+	if err := cache.PutBlob(context.Background(), digest, strings.NewReader("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if missing, err := cache.FindMissingBlobs(context.Background(), []Digest{digest}); err != nil || len(missing) != 0 {
+		t.Fatalf("want the blob to be cached, got missing=%v err=%v", missing, err)
+	}
+	if _, err := cache.GetActionResult(context.Background(), digest.Hash); !errors.Is(err, ErrNotCached) {
+		t.Fatalf("want %v for a missing action, got %v", ErrNotCached, err)
+	}
+}
+
+func TestDecodeTreeRejectsDuplicateNames(t *testing.T) {
+	child := &repb.Directory{Files: []*repb.FileNode{{Name: "f", Digest: digestBytes([]byte("hi")).proto()}}}
+	_, childDigest, err := marshalDigest(child)
+	if err != nil {
+		t.Fatal(err)
+	}
+	treeMsg := &repb.Tree{
+		Root: &repb.Directory{
+			Symlinks:    []*repb.SymlinkNode{{Name: "x", Target: t.TempDir()}},
+			Directories: []*repb.DirectoryNode{{Name: "x", Digest: childDigest.proto()}},
+		},
+		Children: []*repb.Directory{child},
+	}
+	if _, _, err := decodeTree(treeMsg); err == nil {
+		t.Fatal("want a tree with a symlink and a directory of the same name to be rejected")
+	}
+}
+
+func TestRemoteCacheRejectsPoisonedResult(t *testing.T) {
+	chdirTemp(t)
+
+	remote := NewDiskCache("remote")
+	evil := digestBytes([]byte("evil"))
+	if err := remote.PutBlob(context.Background(), evil, strings.NewReader("evil")); err != nil {
+		t.Fatal(err)
+	}
+	result := &repb.ActionResult{OutputFiles: []*repb.OutputFile{{Path: outPath, Digest: evil.proto()}}}
+	good := digestBytes([]byte("good")).Hash
+
+	y := New()
+	y.Remote = remote
+	if err := y.fetchOut(context.Background(), good, result); err == nil {
+		t.Fatal("want a result not matching its checksum to be rejected")
+	}
+	if _, err := os.Stat(y.getCacheLoc(good)); err == nil {
+		t.Fatal("want no tree stored for the claimed checksum")
+	}
+
+	cached := tree{Entries: []treeEntry{{Path: ".", Mode: 0o644, Digest: good}}}
+	if err := writeAtomic(y.getCacheLoc(good), 0o444, func(w io.Writer) error {
+		return json.NewEncoder(w).Encode(cached)
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := y.fetchOut(context.Background(), good, result); err != nil {
+		t.Fatal(err)
+	}
+	if tr, err := y.readTree(good); err != nil || tr.Entries[0].Digest != good {
+		t.Fatalf("want the cached tree kept, got %+v, %v", tr, err)
+	}
+}
@@ -0,0 +1,105 @@
+package yabs
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// root is what a project's latest records reference in the cache, so GC run
+// from any project that shares the cache keeps them
+type root struct {
+	// Records is where the project's records are, the root is dropped once
+	// they're gone
+	Records   string
+	Checksums []string
+	Keys      []string
+}
+
+func (y *Yabs) rootsDir() string {
+	return filepath.Join(y.CacheDir, "roots")
+}
+
+// rootLoc is where the project's root is, named by the hash of its records'
+// path
+func (y *Yabs) rootLoc() (string, error) {
+	records, err := filepath.Abs(y.taskRecordLoc)
+	if err != nil {
+		return "", err
+	}
+	h := sha256.Sum256([]byte(records))
+	return filepath.Join(y.rootsDir(), hex.EncodeToString(h[:])), nil
+}
+
+// saveRoot registers the outputs and actions referenced by records as the
+// project's root
+func (y *Yabs) saveRoot(records []TaskRecord) error {
+	loc, err := y.rootLoc()
+	if err != nil {
+		return fmt.Errorf("writing root: %w", err)
+	}
+	r := root{Checksums: []string{}, Keys: []string{}}
+	if r.Records, err = filepath.Abs(y.taskRecordLoc); err != nil {
+		return fmt.Errorf("writing root: %w", err)
+	}
+	for _, rec := range records {
+		if rec.Checksum != "" {
+			r.Checksums = append(r.Checksums, rec.Checksum)
+		}
+		if rec.Key != "" {
+			r.Keys = append(r.Keys, rec.Key)
+		}
+	}
+	if err := writeAtomic(loc, 0o644, func(w io.Writer) error {
+		return json.NewEncoder(w).Encode(r)
+	}); err != nil {
+		return fmt.Errorf("writing root: %w", err)
+	}
+	return nil
+}
+
+// readRoots reads the roots of every project using the cache, removing the
+// ones whose project's records are gone
+func (y *Yabs) readRoots() ([]root, error) {
+	entries, err := os.ReadDir(y.rootsDir())
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("reading roots: %w", err)
+	}
+	roots := []root{}
+	for _, entry := range entries {
+		loc := filepath.Join(y.rootsDir(), entry.Name())
+		if strings.HasPrefix(entry.Name(), ".tmp-") {
+			if err := os.Remove(loc); err != nil && !errors.Is(err, fs.ErrNotExist) {
+				return nil, fmt.Errorf("removing root: %w", err)
+			}
+			continue
+		}
+		r := root{}
+		bs, err := os.ReadFile(loc)
+		if err != nil {
+			return nil, fmt.Errorf("reading roots: %w", err)
+		}
+		// a corrupt root is kept to be rewritten by its project, until then
+		// its outputs can be evicted
+		if err := json.Unmarshal(bs, &r); err != nil {
+			continue
+		}
+		if _, err := os.Stat(r.Records); errors.Is(err, fs.ErrNotExist) {
+			if err := os.Remove(loc); err != nil && !errors.Is(err, fs.ErrNotExist) {
+				return nil, fmt.Errorf("removing root: %w", err)
+			}
+			continue
+		}
+		roots = append(roots, r)
+	}
+	return roots, nil
+}
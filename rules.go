@@ -1,54 +1,111 @@
 package yabs
 
 import (
+	"errors"
+	"fmt"
 	"io/fs"
-	"log"
 	"os"
+	"path"
 	"path/filepath"
 	"strings"
 
 	"github.com/bmatcuk/doublestar/v4"
 )
 
-func Fs(y *Yabs, name string, globs []string, exclude []string) string {
+func Fs(y *Yabs, name string, globs []string, exclude []string) (string, error) {
 	if len(globs) == 0 {
-		log.Fatalf("list of globs can't be empty")
+		return "", errors.New("list of globs can't be empty")
 	}
-	y.Register(name, []string{}, func(bc BuildCtx) {
-		for _, glob := range globs {
+	y.Register(name, []string{}, func(bc BuildCtx) error {
+		matches, err := fsMatches(globs, exclude)
+		if err != nil {
+			return err
+		}
+		for _, match := range matches {
+			newname := filepath.Join(bc.Out, match)
+			if err := os.MkdirAll(filepath.Dir(newname), os.ModePerm); err != nil {
+				return err
+			}
+			if err := os.Link(match, newname); err != nil {
+				return err
+			}
+		}
+		return nil
+	}, WithAlwaysRun(), WithPlan(func(last string) (string, bool, error) {
+		matches, err := fsMatches(globs, exclude)
+		if err != nil {
+			return "", false, err
+		}
+		checksum, err := fsChecksum(y, matches)
+		return checksum, err == nil, err
+	}))
 
-			err := doublestar.GlobWalk(os.DirFS("."), glob, func(path string, d fs.DirEntry) error {
-				if d.IsDir() {
-					switch d.Name() {
-					case ".git", ".yabs":
-						return doublestar.SkipDir
-					}
-				} else {
-					if strings.HasPrefix(path, ".yabs") {
-						return doublestar.SkipDir
-					}
-					for _, excludeStr := range exclude {
-						if ok, err := doublestar.Match(excludeStr, path); ok {
-							return nil
-						} else if err != nil {
-							return err
-						}
-					}
-					newname := filepath.Join(bc.Out, path)
-					if err := os.MkdirAll(filepath.Dir(newname), os.ModePerm); err != nil {
-						return err
-					}
-					if err := os.Link(path, newname); err != nil {
-						return err
-					}
+	return name, nil
+}
+
+// fsMatches are the files matched by globs, in the order they're found
+func fsMatches(globs []string, exclude []string) ([]string, error) {
+	matches := []string{}
+	for _, glob := range globs {
+		err := doublestar.GlobWalk(os.DirFS("."), glob, func(path string, d fs.DirEntry) error {
+			if d.IsDir() {
+				switch d.Name() {
+				case ".git", ".yabs":
+					return doublestar.SkipDir
 				}
 				return nil
-			})
-			if err != nil {
-				log.Fatalf("traversing glob %q %s", glob, err)
 			}
+			if strings.HasPrefix(path, ".yabs") {
+				return doublestar.SkipDir
+			}
+			for _, excludeStr := range exclude {
+				if ok, err := doublestar.Match(excludeStr, path); ok {
+					return nil
+				} else if err != nil {
+					return err
+				}
+			}
+			matches = append(matches, path)
+			return nil
+		})
+		if err != nil {
+			return nil, fmt.Errorf("traversing glob %q %w", glob, err)
 		}
-	})
+	}
+	return matches, nil
+}
 
-	return name
+// fsChecksum is the checksum of the output Fs makes from matches, computed
+// from the matched files themselves
+func fsChecksum(y *Yabs, matches []string) (string, error) {
+	if len(matches) == 0 {
+		return "", nil
+	}
+	tr := tree{Entries: []treeEntry{{Path: ".", Mode: fs.ModeDir}}}
+	dirs := map[string]bool{".": true}
+	for _, match := range matches {
+		for dir := path.Dir(match); !dirs[dir]; dir = path.Dir(dir) {
+			dirs[dir] = true
+			tr.Entries = append(tr.Entries, treeEntry{Path: dir, Mode: fs.ModeDir})
+		}
+		info, err := os.Lstat(match)
+		if err != nil {
+			return "", err
+		}
+		entry := treeEntry{Path: match, Mode: info.Mode()}
+		switch {
+		case info.Mode()&fs.ModeSymlink != 0:
+			if entry.Link, err = os.Readlink(match); err != nil {
+				return "", err
+			}
+		case info.Mode().IsRegular():
+			if entry.Digest, err = y.hashes.digest(match, info); err != nil {
+				return "", err
+			}
+		default:
+			return "", fmt.Errorf("%q: unsupported file type %s", match, info.Mode().Type())
+		}
+		tr.Entries = append(tr.Entries, entry)
+	}
+	return tr.checksum(), nil
 }
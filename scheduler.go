@@ -4,19 +4,25 @@ import (
 	"context"
 	"fmt"
 	"log"
+	"runtime"
+	"strings"
 	"sync"
+	"time"
 
+	"golang.org/x/exp/slices"
 	"golang.org/x/sync/semaphore"
 )
 
-const POOL_SIZE = 5
-
 type Scheduler struct {
 	taskQueue map[string][]chan *Task
 	taskDone  map[string]bool
+	failed    bool
 	mu        *sync.Mutex
 	y         *Yabs
-	sema      *semaphore.Weighted
+	pool      *pool
+	resources map[string]*semaphore.Weighted
+	jobs      int
+	cancel    context.CancelFunc
 }
 
 func NewScheduler() *Scheduler {
@@ -27,56 +33,204 @@ func NewScheduler() *Scheduler {
 	}
 }
 
-func (s *Scheduler) execTask(t *Task) {
+func (s *Scheduler) execTask(ctx context.Context, t *Task) {
+	err := s.runTask(ctx, t)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err != nil {
+		t.Err = err
+		if !isSkipped(err) {
+			log.Printf("%q failed: %s", t.Name, err)
+			s.failed = true
+			if !s.y.KeepGoing {
+				s.cancel()
+			}
+		}
+	}
+	s.taskDone[t.Name] = true
+	if err == nil {
+		// the records are saved once the build finishes anyway, so a task
+		// that can't be journaled doesn't fail it
+		if err := s.y.journalTask(t); err != nil {
+			log.Printf("journaling %q: %s", t.Name, err)
+		}
+	}
+	for _, ch := range s.taskQueue[t.Name] {
+		ch <- t
+	}
+}
+
+func (s *Scheduler) runTask(ctx context.Context, t *Task) error {
 	out, err := s.y.newTmpOut()
 	if err != nil {
-		log.Fatalf("creating tmp out: %s", err)
+		return fmt.Errorf("creating tmp out: %w", err)
 	}
-	ctx := NewBuildCtx(out)
+	bc := NewBuildCtx(ctx, out)
 	tasks := []<-chan *Task{}
 	for _, dep := range t.Dep {
-		if task, ok := s.y.taskKV[dep]; ok {
-			tasks = append(tasks, s.Schedule(task))
-		} else {
-			fmt.Println("dep not found", dep)
+		task, ok := s.y.taskKV[dep]
+		if !ok {
+			return fmt.Errorf("dep not found: %q", dep)
 		}
+		ch := s.Schedule(ctx, task)
+		if s.jobs == 1 {
+			// finish each dep before scheduling the next so serial builds
+			// always run in the same order
+			done := <-ch
+			ch = make(chan *Task, 1)
+			ch <- done
+		}
+		tasks = append(tasks, ch)
 	}
 
-	dirty := len(tasks) == 0 || t.Dirty
-	maxTime := t.Time
+	depTasks := []*Task{}
+	failedDeps := []string{}
 	for _, task := range tasks {
 		tmpTask := <-task
-		ctx.Dep[tmpTask.Name] = tmpTask.Out
-		dirty = dirty || tmpTask.Dirty
-		if tmpTask.Time > maxTime {
-			maxTime = tmpTask.Time
+		if tmpTask.Err != nil {
+			failedDeps = append(failedDeps, tmpTask.Name)
+			continue
 		}
+		bc.Dep[tmpTask.Name] = tmpTask.Out
+		depTasks = append(depTasks, tmpTask)
+	}
+	if len(failedDeps) > 0 {
+		return fmt.Errorf("%w: %s", ErrDepFailed, strings.Join(failedDeps, ", "))
 	}
-	dirty = dirty || maxTime > t.Time
 
-	t.Dirty = dirty
-	if dirty {
-		if err := s.sema.Acquire(context.Background(), 1); err != nil {
-			log.Fatalf("acquiring: %s", err)
+	t.computeKey(depTasks)
+	reason, cached, err := s.y.dirtyReason(ctx, t, depTasks)
+	if err != nil {
+		return err
+	}
+	t.Reason = reason
+	t.Dirty = t.Reason.Dirty()
+	if !t.Dirty {
+		err := t.restore(s.y, *cached)
+		if err == nil {
+			log.Printf("no actions for %q%s", t.Name, s.logReason(t))
+			if !cached.Remote && s.y.Remote != nil && s.y.RemoteUpload {
+				// cached by a build that didn't upload it
+				if err := s.y.uploadMissingAction(ctx, t.Key, *cached); err != nil {
+					log.Printf("remote cache: uploading %q: %s", t.Name, err)
+				}
+			}
+			return nil
 		}
-		log.Printf("running %q", t.Name)
-		t.Fn(ctx)
-		s.sema.Release(1)
-		t.Out = ctx.Out
-		t.checksumEntries(s.y, ctx)
-	} else {
-		log.Printf("no actions for %q", t.Name)
+		log.Printf("%s, running it instead", err)
+		t.Reason = Reason{Kind: NotCached}
+		t.Dirty = true
 	}
 
+	release, err := s.acquire(ctx, t)
+	if err != nil {
+		return fmt.Errorf("%w: %s", ErrBuildStopped, err)
+	}
+	log.Printf("running %q%s", t.Name, s.logReason(t))
+	start := time.Now()
+	err = t.Fn(bc)
+	release()
+	t.Duration = time.Since(start)
+	if err != nil {
+		if ctx.Err() != nil {
+			return fmt.Errorf("%w: %s", ErrBuildStopped, err)
+		}
+		return err
+	}
+	t.Out = bc.Out
+	if err := t.checksumEntries(s.y, bc); err != nil {
+		return err
+	}
+	if t.AlwaysRun {
+		return nil
+	}
+	res := actionResult{Checksum: t.Checksum}
+	if err := s.y.saveAction(t.Key, res); err != nil {
+		return err
+	}
+	if s.y.Remote != nil && s.y.RemoteUpload {
+		// the build doesn't depend on the remote cache, so it can't fail it
+		if err := s.y.uploadAction(ctx, t.Key, res); err != nil {
+			log.Printf("remote cache: uploading %q: %s", t.Name, err)
+		}
+	}
+	return nil
+}
+
+// logReason is appended to a task's log line when reasons should be logged
+func (s *Scheduler) logReason(t *Task) string {
+	if !s.y.LogReasons {
+		return ""
+	}
+	return fmt.Sprintf(" (%s)", t.Reason)
+}
+
+// acquire waits for the task's named resources and then its weight from the
+// pool, where tasks with a higher priority go first. Named resources are always
+// taken in the same order to avoid deadlocks
+func (s *Scheduler) acquire(ctx context.Context, t *Task) (func(), error) {
+	weight := t.Weight
+	if weight < 1 {
+		weight = 1
+	}
+	// a task heavier than the whole pool would never run
+	if weight > int64(s.jobs) {
+		weight = int64(s.jobs)
+	}
+
+	held := []*semaphore.Weighted{}
+	release := func() {
+		for _, sema := range held {
+			sema.Release(1)
+		}
+	}
+
+	resources := slices.Clone(t.Resources)
+	slices.Sort(resources)
+	for _, name := range slices.Compact(resources) {
+		sema := s.resource(name)
+		if err := sema.Acquire(ctx, 1); err != nil {
+			release()
+			return nil, err
+		}
+		held = append(held, sema)
+	}
+
+	if err := s.pool.Acquire(ctx, weight, t.priority); err != nil {
+		release()
+		return nil, err
+	}
+	if err := ctx.Err(); err != nil {
+		s.pool.Release(weight)
+		release()
+		return nil, err
+	}
+
+	return func() {
+		s.pool.Release(weight)
+		release()
+	}, nil
+}
+
+// resource returns the semaphore for a named resource, resources that weren't
+// given a capacity with Yabs.Resource can only be used by one task at a time
+func (s *Scheduler) resource(name string) *semaphore.Weighted {
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	for _, ch := range s.taskQueue[t.Name] {
-		ch <- t
+	sema, ok := s.resources[name]
+	if !ok {
+		capacity, ok := s.y.resources[name]
+		if !ok || capacity < 1 {
+			capacity = 1
+		}
+		sema = semaphore.NewWeighted(capacity)
+		s.resources[name] = sema
 	}
-	s.taskDone[t.Name] = true
+	return sema
 }
 
-func (s *Scheduler) Schedule(t *Task) chan *Task {
+func (s *Scheduler) Schedule(ctx context.Context, t *Task) chan *Task {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
@@ -91,12 +245,27 @@ func (s *Scheduler) Schedule(t *Task) chan *Task {
 	} else {
 		s.taskQueue[t.Name] = make([]chan *Task, 1)
 		s.taskQueue[t.Name][0] = ch
-		go s.execTask(t)
+		go s.execTask(ctx, t)
 	}
 
 	return ch
 }
 
-func (s *Scheduler) Start() {
-	s.sema = semaphore.NewWeighted(POOL_SIZE)
+// Start readies the scheduler for a build, the returned context is cancelled
+// when a target fails, unless the build should keep going, or on Stop
+func (s *Scheduler) Start(ctx context.Context) context.Context {
+	s.jobs = s.y.Jobs
+	if s.jobs < 1 {
+		s.jobs = runtime.NumCPU()
+	}
+	s.pool = newPool(int64(s.jobs))
+	s.resources = map[string]*semaphore.Weighted{}
+	ctx, s.cancel = context.WithCancel(ctx)
+	return ctx
+}
+
+func (s *Scheduler) Stop() {
+	if s.cancel != nil {
+		s.cancel()
+	}
 }
@@ -0,0 +1,131 @@
+package yabs
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// statCacheMaxAge is how long a file's digest is remembered after it was last
+// used
+const statCacheMaxAge = 30 * 24 * time.Hour
+
+// racyWindow is how recently a file can have been modified for its digest not
+// to be remembered, it could be modified again without its mtime changing
+const racyWindow = 2 * time.Second
+
+// statCache remembers the digests of files by their size and mtime so files
+// that haven't changed aren't read again. Outputs are built in a new temp dir
+// each time, so files are identified by their inode instead of their path,
+// which also covers the hardlinks fs() makes to its inputs. Inodes are reused
+// once the temp dirs are removed, so the ID also includes when the inode was
+// created, see fileID.
+type statCache struct {
+	mu      sync.Mutex
+	entries map[string]statEntry
+	// rehash ignores the remembered digests, they're still updated
+	rehash bool
+	now    time.Time
+}
+
+type statEntry struct {
+	Size    int64
+	ModTime time.Time
+	Digest  string
+	// Used is when the digest was last used
+	Used time.Time
+}
+
+func (y *Yabs) statCacheLoc() string {
+	return filepath.Join(y.tmpDir, "statcache.json")
+}
+
+// loadStatCache reads the digests remembered by previous builds, a missing or
+// corrupt stat cache is started over
+func (y *Yabs) loadStatCache() *statCache {
+	c := &statCache{entries: map[string]statEntry{}, rehash: y.Rehash, now: time.Now()}
+	bs, err := os.ReadFile(y.statCacheLoc())
+	if err != nil {
+		return c
+	}
+	if err := json.Unmarshal(bs, &c.entries); err != nil {
+		c.entries = map[string]statEntry{}
+	}
+	return c
+}
+
+// saveStatCache writes the remembered digests, dropping the ones that haven't
+// been used for statCacheMaxAge
+func (y *Yabs) saveStatCache() error {
+	c := y.hashes
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for id, entry := range c.entries {
+		if c.now.Sub(entry.Used) > statCacheMaxAge {
+			delete(c.entries, id)
+		}
+	}
+	if err := writeAtomic(y.statCacheLoc(), 0o644, func(w io.Writer) error {
+		return json.NewEncoder(w).Encode(c.entries)
+	}); err != nil {
+		return fmt.Errorf("writing stat cache: %w", err)
+	}
+	return nil
+}
+
+// lookup returns the remembered digest of a regular file, if it hasn't
+// changed since it was hashed
+func (c *statCache) lookup(path string, info fs.FileInfo) (string, bool) {
+	if c == nil || c.rehash {
+		return "", false
+	}
+	id, ok := fileID(path)
+	if !ok {
+		return "", false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, found := c.entries[id]
+	if !found || entry.Size != info.Size() || !entry.ModTime.Equal(info.ModTime()) {
+		return "", false
+	}
+	entry.Used = c.now
+	c.entries[id] = entry
+	return entry.Digest, true
+}
+
+// digest returns the sha256 of a regular file's contents, only reading the
+// file if it's changed since it was last hashed
+func (c *statCache) digest(path string, info fs.FileInfo) (string, error) {
+	if digest, ok := c.lookup(path, info); ok {
+		return digest, nil
+	}
+	digest, err := checksumFile(path)
+	if err != nil {
+		return "", err
+	}
+	c.remember(path, info, digest)
+	return digest, nil
+}
+
+// remember records the digest of a file that was just hashed
+func (c *statCache) remember(path string, info fs.FileInfo, digest string) {
+	if c == nil || time.Since(info.ModTime()) < racyWindow {
+		return
+	}
+	id, ok := fileID(path)
+	if !ok {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries[id] = statEntry{Size: info.Size(), ModTime: info.ModTime(), Digest: digest, Used: c.now}
+}
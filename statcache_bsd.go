@@ -0,0 +1,20 @@
+//go:build darwin || freebsd || netbsd
+
+package yabs
+
+import (
+	"fmt"
+
+	"golang.org/x/sys/unix"
+)
+
+// fileID identifies a file by its device, inode and birth time, which tells a
+// recreated file apart from the last file with the same inode. Hardlinks share
+// an ID.
+func fileID(path string) (string, bool) {
+	st := unix.Stat_t{}
+	if err := unix.Stat(path, &st); err != nil {
+		return "", false
+	}
+	return fmt.Sprintf("%d:%d:%d.%d", st.Dev, st.Ino, st.Btim.Sec, st.Btim.Nsec), true
+}
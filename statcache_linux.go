@@ -0,0 +1,25 @@
+//go:build linux
+
+package yabs
+
+import (
+	"fmt"
+
+	"golang.org/x/sys/unix"
+)
+
+// fileID identifies a file by its device, inode and birth time, which tells a
+// recreated file apart from the last file with the same inode. Hardlinks share
+// an ID. Filesystems without birth times use the ctime instead, which also
+// changes when the file is hardlinked.
+func fileID(path string) (string, bool) {
+	st := unix.Statx_t{}
+	if err := unix.Statx(unix.AT_FDCWD, path, 0, unix.STATX_INO|unix.STATX_BTIME|unix.STATX_CTIME, &st); err != nil {
+		return "", false
+	}
+	born := st.Ctime
+	if st.Mask&unix.STATX_BTIME != 0 {
+		born = st.Btime
+	}
+	return fmt.Sprintf("%d:%d:%d:%d.%d", st.Dev_major, st.Dev_minor, st.Ino, born.Sec, born.Nsec), true
+}
@@ -0,0 +1,20 @@
+//go:build !windows && !linux && !darwin && !freebsd && !netbsd
+
+package yabs
+
+import (
+	"fmt"
+
+	"golang.org/x/sys/unix"
+)
+
+// fileID identifies a file by its device, inode and ctime. The ctime tells a
+// recreated file apart from the last file with the same inode, but it also
+// changes when the file is hardlinked.
+func fileID(path string) (string, bool) {
+	st := unix.Stat_t{}
+	if err := unix.Stat(path, &st); err != nil {
+		return "", false
+	}
+	return fmt.Sprintf("%d:%d:%d.%d", st.Dev, st.Ino, st.Ctim.Sec, st.Ctim.Nsec), true
+}
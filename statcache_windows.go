@@ -0,0 +1,9 @@
+//go:build windows
+
+package yabs
+
+// fileID is unknown on windows, os.FileInfo doesn't carry the file index so
+// files are always hashed
+func fileID(path string) (string, bool) {
+	return "", false
+}
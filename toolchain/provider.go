@@ -6,6 +6,7 @@ import (
 	"bufio"
 	"bytes"
 	"compress/gzip"
+	"context"
 	"fmt"
 	"io"
 	"io/fs"
@@ -27,27 +28,35 @@ type ToolchainProvider struct {
 	BinLoc []string
 	// Function to get the download URL of the toolchain, based on the provider
 	DownloadURL DownloadURLFunc
+	// Dir is where toolchains are downloaded to, defaults to `.yabs`
+	Dir string
 }
 
 type DownloadURLFunc func(ToolchainProvider) string
 
 func (tp ToolchainProvider) getPrefix() string {
-	return fmt.Sprintf(".yabs/%s/%s", tp.Type, tp.Version)
+	dir := tp.Dir
+	if dir == "" {
+		dir = ".yabs"
+	}
+	return filepath.Join(dir, tp.Type, tp.Version)
 }
 
 func (tp ToolchainProvider) GetTargetName() string {
 	return fmt.Sprintf("%s@%s", tp.Type, tp.Version)
 }
 
+// Register adds the toolchain's target, it always runs so a removed toolchain
+// is downloaded again, and its output only changes with the version
 func (tp ToolchainProvider) Register(y *yabs.Yabs) {
 	name := tp.GetTargetName()
-	y.Register(name, []string{}, func(bc yabs.BuildCtx) {
-		if err := tp.Download(); err != nil {
-			log.Fatal(err)
+	y.Register(name, []string{}, func(bc yabs.BuildCtx) error {
+		if err := tp.Download(bc.Context()); err != nil {
+			return err
 		}
 
 		if err := os.Mkdir(bc.Out, os.ModePerm); err != nil {
-			log.Fatal(err)
+			return err
 		}
 
 		binLoc := filepath.Join(append([]string{tp.getPrefix()}, tp.BinLoc...)...)
@@ -67,56 +76,91 @@ func (tp ToolchainProvider) Register(y *yabs.Yabs) {
 
 				absLk, err := filepath.Abs(lk)
 				if err != nil {
-					log.Fatal(err)
+					return err
 				}
 				relLk, err := filepath.Rel(filepath.Dir(loc), absLk)
 				if err != nil {
-					log.Fatal(err)
+					return err
 				}
 
 				if err = os.Symlink(relLk, loc); err != nil {
 					return err
 				}
 			} else if !d.IsDir() {
-				if err = os.Link(path, loc); err != nil {
+				info, err := d.Info()
+				if err != nil {
+					return err
+				}
+				// toolchains can be on another filesystem than the output
+				if err = yabs.LinkOrCopy(path, loc, info.Mode().Perm()); err != nil {
 					return err
 				}
 			} else {
 				if err := os.MkdirAll(loc, os.ModePerm); err != nil {
-					log.Fatal(err)
+					return err
 				}
 			}
 			return nil
 		}); err != nil {
-			log.Fatal(err)
+			return err
+		}
+		return nil
+	}, yabs.WithAlwaysRun(), yabs.WithPlan(func(last string) (string, bool, error) {
+		// a downloaded toolchain is linked into the same output every time
+		if _, err := os.Stat(tp.getPrefix()); err != nil || last == "" {
+			return "", false, nil
 		}
-	})
+		return last, true, nil
+	}))
 }
 
-func (tp ToolchainProvider) Download() error {
+func (tp ToolchainProvider) Download(ctx context.Context) error {
 	downloadUrl := tp.DownloadURL(tp)
 
 	prefix := tp.getPrefix()
 
-	if _, err := os.Stat(prefix); os.IsNotExist(err) {
-		if err = os.MkdirAll(prefix, os.ModePerm); err != nil {
-			log.Fatalf("downloading: %s", err)
-		}
-	} else {
+	// other yabs processes may be downloading the same toolchain
+	lock, err := yabs.OpenLock(prefix + ".lock")
+	if err != nil {
+		return fmt.Errorf("downloading: %w", err)
+	}
+	if err := lock.Lock(); err != nil {
+		return fmt.Errorf("downloading: %w", err)
+	}
+	defer lock.Unlock()
+
+	if _, err := os.Stat(prefix); err == nil {
 		log.Printf("already have %s@%s", tp.Type, tp.Version)
 		return nil
+	} else if !os.IsNotExist(err) {
+		return fmt.Errorf("downloading: %w", err)
+	}
+
+	// extracted to the side so an interrupted download is never mistaken for
+	// a complete one
+	tmp := prefix + ".tmp"
+	if err := os.RemoveAll(tmp); err != nil {
+		return fmt.Errorf("downloading: %w", err)
+	}
+	if err := os.MkdirAll(tmp, os.ModePerm); err != nil {
+		return fmt.Errorf("downloading: %w", err)
 	}
+	defer os.RemoveAll(tmp)
 
 	log.Printf("downloading %s@%s from %s", tp.Type, tp.Version, downloadUrl)
 
-	resp, err := http.Get(downloadUrl)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, downloadUrl, nil)
 	if err != nil {
-		log.Fatalf("getting: %s", err)
+		return fmt.Errorf("getting: %w", err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("getting: %w", err)
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
-		log.Fatalf("bad status: %s", resp.Status)
+		return fmt.Errorf("bad status: %s", resp.Status)
 	}
 
 	if runtime.GOOS == "windows" {
@@ -124,29 +168,32 @@ func (tp ToolchainProvider) Download() error {
 		writer := bufio.NewWriter(&buf)
 		size, err := io.Copy(writer, resp.Body)
 		if err != nil {
-			log.Fatalf("writing zip to buf: %s", err)
+			return fmt.Errorf("writing zip to buf: %w", err)
 		}
 
 		reader := bytes.NewReader(buf.Bytes())
 		log.Printf("extracting zip")
-		if err := tp.extractZip(prefix, reader, size); err != nil {
-			log.Fatal(err)
+		if err := tp.extractZip(tmp, reader, size); err != nil {
+			return err
 		}
 
 	} else {
 		log.Printf("extracting tar.gz")
-		if err := tp.extractTarGz(prefix, resp.Body); err != nil {
-			log.Fatal(err)
+		if err := tp.extractTarGz(tmp, resp.Body); err != nil {
+			return err
 		}
 	}
 
+	if err := os.Rename(tmp, prefix); err != nil {
+		return fmt.Errorf("downloading: %w", err)
+	}
 	return nil
 }
 
 func (tp ToolchainProvider) extractTarGz(prefix string, r io.Reader) error {
 	tarStream, err := gzip.NewReader(r)
 	if err != nil {
-		log.Fatalf("tar gz: gzip: %s", err)
+		return fmt.Errorf("tar gz: gzip: %w", err)
 	}
 
 	tarReader := tar.NewReader(tarStream)
@@ -161,7 +208,7 @@ func (tp ToolchainProvider) extractTarGz(prefix string, r io.Reader) error {
 		}
 
 		if err != nil {
-			log.Fatalf("ExtractTarGz: Next() failed: %s", err.Error())
+			return fmt.Errorf("ExtractTarGz: Next() failed: %w", err)
 		}
 
 		name := filepath.Join(prefix, header.Name)
@@ -169,25 +216,25 @@ func (tp ToolchainProvider) extractTarGz(prefix string, r io.Reader) error {
 		switch header.Typeflag {
 		case tar.TypeDir:
 			if err := os.Mkdir(name, os.ModePerm); err != nil {
-				log.Fatalf("ExtractTarGz: Mkdir() failed: %s", err.Error())
+				return fmt.Errorf("ExtractTarGz: Mkdir() failed: %w", err)
 			}
 		case tar.TypeReg:
 			outFile, err := os.OpenFile(name, os.O_CREATE|os.O_RDWR, 0777)
 			if err != nil {
-				log.Fatalf("ExtractTarGz: Create() failed: %s", err.Error())
+				return fmt.Errorf("ExtractTarGz: Create() failed: %w", err)
 			}
 			defer outFile.Close()
 			if _, err := io.Copy(outFile, tarReader); err != nil {
-				log.Fatalf("ExtractTarGz: Copy() failed: %s", err.Error())
+				return fmt.Errorf("ExtractTarGz: Copy() failed: %w", err)
 			}
 		case tar.TypeSymlink:
 			// fullLink := filepath.Join(prefix, filepath.Dir(header.Name), header.Linkname)
 			// symlinks[fullLink] = name
 			if err := os.Symlink(header.Linkname, name); err != nil {
-				log.Fatalf("extracttargz: %s", err)
+				return fmt.Errorf("extracttargz: %w", err)
 			}
 		default:
-			log.Fatalf(
+			return fmt.Errorf(
 				"ExtractTarGz: unknown type: %c in %s",
 				header.Typeflag,
 				header.Name)
@@ -196,7 +243,7 @@ func (tp ToolchainProvider) extractTarGz(prefix string, r io.Reader) error {
 
 	for fullLink, name := range symlinks {
 		if err := os.Symlink(fullLink, name); err != nil {
-			log.Fatal(err)
+			return err
 		}
 	}
 
@@ -26,9 +26,10 @@ func (t *Toolchain) Go(version string) string {
 }
 
 func Go(bs *yabs.Yabs, version string) string {
-	goRoot, _ := filepath.Abs(filepath.Join(".yabs", "go", version, "go"))
-	goPath, _ := filepath.Abs(filepath.Join(".yabs", "go"))
-	goCache, _ := filepath.Abs(filepath.Join(".yabs", "go", "go-build"))
+	dir := filepath.Join(bs.CacheDir, "toolchains")
+	goRoot, _ := filepath.Abs(filepath.Join(dir, "go", version, "go"))
+	goPath, _ := filepath.Abs(filepath.Join(dir, "go"))
+	goCache, _ := filepath.Abs(filepath.Join(dir, "go", "go-build"))
 
 	goBinPath, _ := filepath.Abs(filepath.Join(goRoot, "bin"))
 	os.Setenv("GOROOT", goRoot)
@@ -41,6 +42,7 @@ func Go(bs *yabs.Yabs, version string) string {
 		Type:    "go",
 		Version: version,
 		BinLoc:  []string{"go", "bin"},
+		Dir:     dir,
 		DownloadURL: func(tp ToolchainProvider) string {
 			os := runtime.GOOS
 			arch := runtime.GOARCH
@@ -79,6 +81,7 @@ func Node(bs *yabs.Yabs, version string) string {
 		Type:    "node",
 		Version: version,
 		BinLoc:  []string{fileName, "bin"},
+		Dir:     filepath.Join(bs.CacheDir, "toolchains"),
 		DownloadURL: func(tp ToolchainProvider) string {
 			// https://nodejs.org/dist/v18.17.1/node-v18.17.1-linux-arm64.tar.xz
 			return fmt.Sprintf("https://nodejs.org/dist/%s/%s.%s", version, fileName, ext)
@@ -87,7 +90,7 @@ func Node(bs *yabs.Yabs, version string) string {
 
 	bin := filepath.Join(tp.BinLoc...)
 	nodeBinAbs, _ := filepath.Abs(filepath.Join(tp.getPrefix(), bin))
-	npmCacheAbs, _ := filepath.Abs(filepath.Join(".yabs", "node", ".npm_cache"))
+	npmCacheAbs, _ := filepath.Abs(filepath.Join(tp.Dir, "node", ".npm_cache"))
 
 	path := os.Getenv("PATH")
 	os.Setenv("PATH", nodeBinAbs+":"+path)
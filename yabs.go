@@ -1,9 +1,9 @@
 package yabs
 
 import (
+	"context"
 	"crypto/sha256"
 	"encoding/hex"
-	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
@@ -11,16 +11,17 @@ import (
 	"log"
 	"math/rand"
 	"os"
-	"os/exec"
 	"path/filepath"
 	"strconv"
 	"strings"
+	"time"
 
 	"golang.org/x/exp/slices"
 )
 
 type RunConfig struct {
 	Cmd []string
+	ctx context.Context
 	env map[string]string
 	out string
 }
@@ -46,7 +47,7 @@ func (r *RunConfig) Exec() error {
 		defer fd.Close()
 	}
 
-	cmd := exec.Command(r.Cmd[0], r.Cmd[1:]...)
+	cmd := CommandContext(r.ctx, r.Cmd[0], r.Cmd[1:]...)
 	cmd.Stdout = fd
 	cmd.Stderr = os.Stderr
 
@@ -91,7 +92,7 @@ func (y *Yabs) newTmpOut() (string, error) {
 		return "", err
 	}
 	if err := os.MkdirAll(filepath.Dir(tmp), os.ModePerm); err != nil && !os.IsExist(err) {
-		log.Fatalf("tmpout: %s", err)
+		return "", fmt.Errorf("tmpout: %w", err)
 	}
 	return tmp, nil
 }
@@ -99,12 +100,12 @@ func (y *Yabs) newTmpOut() (string, error) {
 func getFileChecksum(path string) ([]byte, error) {
 	st, err := os.Lstat(path)
 	if err != nil {
-		log.Fatalf("file checksum: %s", err)
+		return nil, fmt.Errorf("file checksum: %w", err)
 	}
 	if st.Mode()&fs.ModeSymlink != 0 {
 		lk, err := filepath.EvalSymlinks(path)
 		if err != nil {
-			log.Fatalf("file checksum: %s", err)
+			return nil, fmt.Errorf("file checksum: %w", err)
 		}
 		return getFileChecksum(lk)
 	}
@@ -122,65 +123,59 @@ func getFileChecksum(path string) ([]byte, error) {
 	return h.Sum(nil), nil
 }
 
-func checksumFile(loc string) string {
+func checksumFile(loc string) (string, error) {
 	sum, err := getFileChecksum(loc)
 
 	if err != nil {
-		log.Fatalf("checksum file: %s", err)
+		return "", fmt.Errorf("checksum file: %w", err)
 	}
 
-	return hex.EncodeToString(sum)
+	return hex.EncodeToString(sum), nil
 }
 
-func checksumDir(loc string) string {
-
-	hsh := sha256.New()
-
-	err := filepath.Walk(loc, func(path string, info fs.FileInfo, err error) error {
-		if err != nil {
-			return err
-		}
-
-		if info.IsDir() {
-			return nil
-		}
-
-		sum, err := getFileChecksum(path)
-		if err != nil {
-			return err
-		}
-
-		_, err = hsh.Write(sum)
-		if err != nil {
-			return err
-		}
-
-		return nil
-	})
+// checksumVersion is bumped whenever the way outputs are checksummed changes,
+// it's part of action keys and records so nothing checksummed the old way is
+// reused
+const checksumVersion = 3
 
+// checksumDir checksums a directory output, the digests of files in hashes
+// are used instead of reading them
+func checksumDir(loc string, hashes *statCache) (string, error) {
+	tr, err := walkTree(loc, hashes.digest)
 	if err != nil {
-		log.Fatalf("file walk: %s", err)
+		return "", fmt.Errorf("file walk: %w", err)
 	}
-
-	return hex.EncodeToString(hsh.Sum(nil))
+	return tr.checksum(), nil
 }
 
 type BuildCtx struct {
 	// Run func(name string, args ...string) *RunConfig
 	Out string
 	Dep map[string]string
+	ctx context.Context
 }
 
-func NewBuildCtx(out string) BuildCtx {
+func NewBuildCtx(ctx context.Context, out string) BuildCtx {
 	return BuildCtx{
 		Out: out,
 		Dep: map[string]string{},
+		ctx: ctx,
+	}
+}
+
+// Context is cancelled when the build is stopped, commands started by the
+// target should be tied to it
+func (bc BuildCtx) Context() context.Context {
+	if bc.ctx == nil {
+		return context.Background()
 	}
+	return bc.ctx
 }
 
-func (BuildCtx) Run(name string, args ...string) *RunConfig {
+func (bc BuildCtx) Run(name string, args ...string) *RunConfig {
 	return &RunConfig{
 		Cmd: append([]string{name}, args...),
+		ctx: bc.Context(),
 		env: map[string]string{},
 		out: "",
 	}
@@ -194,7 +189,21 @@ type TaskRecord struct {
 	Name     string
 	Checksum string
 	Deps     []string
-	Time     int64
+	// Key is the action key the task last ran or was restored with
+	Key string
+	// FnHash identifies the task's function when it last ran
+	FnHash string `json:",omitempty"`
+	// DepDigests are the digests of the deps' outputs that went into Key
+	DepDigests map[string]string `json:",omitempty"`
+	// Env are the hashed values of the task's env vars that went into Key,
+	// hashed so secrets aren't written to disk
+	Env map[string]string `json:",omitempty"`
+	// Duration is how long the task took the last time it ran
+	Duration time.Duration
+	// Reason is why the task ran or was skipped in the last build it was part of
+	Reason Reason
+	// ChecksumVersion is the checksumVersion Checksum was computed with
+	ChecksumVersion int
 }
 
 type Task struct {
@@ -204,70 +213,150 @@ type Task struct {
 	Out      string
 	Checksum string
 	Dirty    bool
-	Time     int64
+	// Key identifies everything that goes into running the task, it's known
+	// once the task's deps have finished
+	Key string
+	// FnHash identifies the task's function, changing it changes the task's
+	// action key. Tasks registered from Go code don't have one by default
+	FnHash string
+	// Env are the names of env vars the task reads, changing any of them
+	// reruns the task
+	Env []string
+	// AlwaysRun tasks run every build instead of being restored from the
+	// cache, for tasks that read inputs yabs can't see like the filesystem
+	AlwaysRun bool
+	// Plan predicts the output of a task that always runs for a dry run, nil
+	// if it can't be predicted
+	Plan PlanFunc
+	// Loc is where the task was registered, e.g. `build.yb:12`, if known
+	Loc string
+	// Weight is how many of the scheduler's jobs the task takes up while running
+	Weight int64
+	// Resources are named resources held while the task runs, limiting how
+	// many tasks using the same resource can run at once
+	Resources []string
+	// Duration is how long the task took the last time it ran
+	Duration time.Duration
+	// Reason is why the task ran or was skipped in this build
+	Reason Reason
+	// depDigests are the digests of the deps' outputs that went into Key
+	depDigests map[string]string
+	// envDigests are the hashed values of the env vars that went into Key
+	envDigests map[string]string
+	// priority is the estimated time from the start of this task to the end of
+	// the build, tasks on the critical path go first
+	priority time.Duration
+	// Err is set once the task has finished if it failed or was skipped
+	Err error
 }
 
-type OutType int
+// TaskOption configures a task when it's registered
+type TaskOption func(*Task)
 
-const (
-	None OutType = iota
-	File
-	Dir
-)
+// WithLocation records where a task was registered for error messages
+func WithLocation(loc string) TaskOption {
+	return func(t *Task) {
+		t.Loc = loc
+	}
+}
 
-func (y *Yabs) getCacheLoc(checksum string) string {
-	return filepath.Join(y.tmpDir, "cache", checksum[:2], checksum[2:])
+// WithFnHash sets the hash identifying the task's function, so editing the
+// function reruns the task
+func WithFnHash(hash string) TaskOption {
+	return func(t *Task) {
+		t.FnHash = hash
+	}
 }
 
-func removeDir(path string) {
-	abs, _ := filepath.Abs(filepath.Join(".yabs", "out"))
-	if !strings.HasPrefix(path, abs) {
-		log.Fatalf("about to remove a non-out dir: %q", path)
+// WithEnv declares env vars the task reads, their values are part of its
+// action key
+func WithEnv(names ...string) TaskOption {
+	return func(t *Task) {
+		t.Env = append(t.Env, names...)
 	}
+}
 
-	if err := os.RemoveAll(path); err != nil {
-		log.Fatalf("remove dir: %s", err)
+// WithAlwaysRun makes the task run every build
+func WithAlwaysRun() TaskOption {
+	return func(t *Task) {
+		t.AlwaysRun = true
 	}
 }
 
-func (t *Task) cache(y *Yabs, outType OutType) {
-	loc := y.getCacheLoc(t.Checksum)
-	if err := os.MkdirAll(filepath.Dir(loc), os.ModePerm); err != nil && !os.IsExist(err) {
-		log.Fatalf("creating parent dir: %s", err)
+// PlanFunc predicts the checksum a task that always runs would produce,
+// without side effects. last is the checksum it produced last time, "" if it
+// has no record. ok is false if the checksum can't be known without running
+// the task.
+type PlanFunc func(last string) (checksum string, ok bool, err error)
+
+// WithPlan lets a dry run predict the output of a task that always runs,
+// instead of assuming its dependents would run
+func WithPlan(plan PlanFunc) TaskOption {
+	return func(t *Task) {
+		t.Plan = plan
 	}
+}
 
-	_, err := os.Lstat(loc)
-	if err == nil {
-		return
+// WithWeight makes a heavy task take up more than one job while it runs
+func WithWeight(weight int64) TaskOption {
+	return func(t *Task) {
+		t.Weight = weight
+	}
+}
+
+// WithResources makes a task hold the named resources while it runs
+func WithResources(names ...string) TaskOption {
+	return func(t *Task) {
+		t.Resources = append(t.Resources, names...)
+	}
+}
+
+type OutType int
+
+const (
+	None OutType = iota
+	File
+	Dir
+)
+
+func removeDir(path string) error {
+	abs, _ := filepath.Abs(filepath.Join(".yabs", "out"))
+	if !strings.HasPrefix(path, abs) {
+		return fmt.Errorf("about to remove a non-out dir: %q", path)
 	}
 
-	if err = os.Symlink(t.Out, loc); err != nil {
-		log.Fatalf("creating link: %s", err)
+	if err := os.RemoveAll(path); err != nil {
+		return fmt.Errorf("remove dir: %w", err)
 	}
+	return nil
 }
 
-func isEmptyDir(path string) bool {
+func isEmptyDir(path string) (bool, error) {
 	f, err := os.Open(path)
 	if err != nil {
 		if os.IsNotExist(err) {
-			return false
+			return false, nil
 		}
-		log.Fatalf("isEmptyDir: %s", err)
+		return false, fmt.Errorf("isEmptyDir: %w", err)
 	}
 	defer f.Close()
 
 	_, err = f.Readdirnames(1)
-	return err == io.EOF
+	return err == io.EOF, nil
 }
 
-func (t *Task) checksumEntries(y *Yabs, ctx BuildCtx) {
+func (t *Task) checksumEntries(y *Yabs, ctx BuildCtx) error {
 	outType := None
 	fd, err := os.Stat(t.Out)
 	if err != nil && !errors.Is(err, os.ErrNotExist) {
-		log.Fatalf("stat tmp out: %s", err)
+		return fmt.Errorf("stat tmp out: %w", err)
 	} else if fd != nil {
 		if fd.IsDir() {
-			if isEmptyDir(t.Out) {
+			empty, err := isEmptyDir(t.Out)
+			if err != nil {
+				return err
+			}
+			if empty {
 				outType = None
 			} else {
 				outType = Dir
@@ -285,52 +374,103 @@ func (t *Task) checksumEntries(y *Yabs, ctx BuildCtx) {
 
 	switch outType {
 	case File:
-		checksum = checksumFile(t.Out)
+		var digest string
+		if digest, err = y.hashes.digest(t.Out, fd); err == nil {
+			checksum = fileChecksum(digest, fd.Mode())
+		}
 	case Dir:
-		checksum = checksumDir(t.Out)
+		checksum, err = checksumDir(t.Out, y.hashes)
 	case None:
 		t.Out = ""
-		return
+		t.Checksum = ""
+		return nil
 	}
-
-	if checksum == t.Checksum {
-		t.Dirty = false
-		removeDir(t.Out)
-		out := y.getCacheLoc(t.Checksum)
-		lk, _ := os.Readlink(out)
-		t.Out = lk
-		return
-	} else {
-		t.Checksum = checksum
+	if err != nil {
+		return err
 	}
 
-	t.cache(y, outType)
+	t.Checksum = checksum
+	return y.storeOut(t)
 }
 
-type BuildCtxFunc func(BuildCtx)
+type BuildCtxFunc func(BuildCtx) error
 
 //
 
 type Yabs struct {
+	// KeepGoing continues building every target that doesn't depend on a
+	// failed target, instead of stopping at the first failure
+	KeepGoing bool
+	// Jobs is the number of targets that can run at once, defaults to the
+	// number of CPUs. A single job runs targets in a deterministic order
+	Jobs int
+	// LogReasons adds why each target is run or skipped to the build's logs
+	LogReasons bool
+	// CacheDir is where outputs, actions and toolchains are cached, it can be
+	// shared between projects and checkouts. Defaults to DefaultCacheDir
+	CacheDir string
+	// Remote is checked for actions missing from CacheDir, nil if there's no
+	// remote cache
+	Remote CacheBackend
+	// RemoteUpload uploads the results of actions run by this build to Remote,
+	// along with the ones restored from the local cache that Remote is missing
+	RemoteUpload bool
+	// CacheLimits are applied to the cache after each build, unless another
+	// build is using it
+	CacheLimits CacheLimits
+	// NoWait fails a build straight away when another yabs process is using
+	// the project, instead of waiting for it to finish
+	NoWait bool
+	// Rehash reads every file of every output, instead of trusting the digests
+	// of files that haven't changed since they were last hashed
+	Rehash bool
+
 	scheduler     *Scheduler
 	taskKV        map[string]*Task
+	resources     map[string]int64
+	records       map[string]TaskRecord
+	hashes        *statCache
+	journal       *os.File
 	taskRecordLoc string
 	tmpDir        string
-	time          int64
+}
+
+// record is the record of a task that completed, ok is false if there's
+// nothing worth recording
+func (t *Task) record() (rec TaskRecord, ok bool) {
+	if t.Checksum == "" && len(t.Dep) == 0 {
+		return rec, false
+	}
+	slices.Sort(t.Dep)
+	return TaskRecord{
+		Name:       t.Name,
+		Checksum:   t.Checksum,
+		Deps:       t.Dep,
+		Key:        t.Key,
+		FnHash:     t.FnHash,
+		DepDigests: t.depDigests,
+		Env:        t.envDigests,
+		Duration:   t.Duration,
+		Reason:     t.Reason,
+
+		ChecksumVersion: checksumVersion,
+	}, true
 }
 
 func (y *Yabs) getTaskRecords() []TaskRecord {
 	taskRecords := []TaskRecord{}
 	for name, task := range y.taskKV {
-		if task.Checksum == "" && len(task.Dep) == 0 {
+		// tasks that didn't complete keep whatever was recorded for them last time
+		if !y.scheduler.taskDone[task.Name] || task.Err != nil {
+			if rec, ok := y.records[name]; ok {
+				taskRecords = append(taskRecords, rec)
+			}
 			continue
 		}
 
-		slices.Sort(task.Dep)
-		if y.scheduler.taskDone[task.Name] && task.Dirty {
-			task.Time = y.time
+		if rec, ok := task.record(); ok {
+			taskRecords = append(taskRecords, rec)
 		}
-		taskRecords = append(taskRecords, TaskRecord{Checksum: task.Checksum, Name: name, Deps: task.Dep, Time: task.Time})
 	}
 
 	slices.SortFunc(taskRecords, func(a, b TaskRecord) int {
@@ -340,20 +480,27 @@ func (y *Yabs) getTaskRecords() []TaskRecord {
 	return taskRecords
 }
 
+// DefaultCacheDir is $YABS_CACHE_DIR if it's set, otherwise yabs' dir in the
+// user's cache dir, e.g. ~/.cache/yabs
+func DefaultCacheDir() string {
+	if dir := os.Getenv("YABS_CACHE_DIR"); dir != "" {
+		return dir
+	}
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return filepath.Join(".yabs", "cache")
+	}
+	return filepath.Join(dir, "yabs")
+}
+
 func New() *Yabs {
-	tmpDir := func() string {
-		path := ".yabs"
-		if _, err := os.Stat(path); errors.Is(err, os.ErrNotExist) {
-			err := os.Mkdir(path, os.ModePerm)
-			if err != nil {
-				log.Fatalf("creating tmp dir: %s", err)
-			}
-		}
-		return ".yabs"
-	}()
+	tmpDir := ".yabs"
 	y := &Yabs{
+		CacheDir:      DefaultCacheDir(),
 		scheduler:     NewScheduler(),
 		taskKV:        map[string]*Task{},
+		resources:     map[string]int64{},
+		records:       map[string]TaskRecord{},
 		taskRecordLoc: filepath.Join(tmpDir, ".records.json"),
 		tmpDir:        tmpDir,
 	}
@@ -362,162 +509,218 @@ func New() *Yabs {
 	return y
 }
 
-func (y *Yabs) SaveTasks() {
-	taskRecords := y.getTaskRecords()
-
-	bs, err := json.MarshalIndent(taskRecords, "", "	")
+// SaveTasks writes the records of this build's tasks, compacting the journal
+// they were recorded in as they completed. The file is replaced atomically so
+// a crash while saving leaves the previous records intact.
+func (y *Yabs) SaveTasks() error {
+	records := y.getTaskRecords()
+	bs, err := encodeRecords(records)
 	if err != nil {
-		log.Fatalf("marshing records: %s", err)
+		return fmt.Errorf("marshing records: %w", err)
 	}
-
-	fd, err := os.Create(y.taskRecordLoc)
-	if err != nil {
-		log.Fatalf("opening file: %s", err)
+	if err := writeAtomic(y.taskRecordLoc, 0o644, func(w io.Writer) error {
+		_, err := w.Write(bs)
+		return err
+	}); err != nil {
+		return fmt.Errorf("writing records: %w", err)
 	}
-	defer fd.Close()
-
-	if _, err = fd.Write(bs); err != nil {
-		log.Fatalf("writing to file: %s", err)
+	if err := y.saveRoot(records); err != nil {
+		return err
 	}
+	return y.removeJournal()
 }
 
-func (y *Yabs) RestoreTasks() {
-	fd, err := os.Open(y.taskRecordLoc)
-	if err != nil {
-		if os.IsNotExist(err) {
-			return
+// RestoreTasks reads the records of the last build, along with the records of
+// tasks that completed in a build that didn't get to save them. Records that
+// can't be read are ignored with a warning, every target is then checked
+// against the cache as if it had never been built.
+func (y *Yabs) RestoreTasks() error {
+	taskRecords := []TaskRecord{}
+	bs, err := os.ReadFile(y.taskRecordLoc)
+	switch {
+	case err == nil:
+		if taskRecords, err = decodeRecords(bs); err != nil {
+			log.Printf("warning: ignoring unreadable task records %s: %s", y.taskRecordLoc, err)
 		}
-		log.Fatalf("opening file: %s", err)
+	case !os.IsNotExist(err):
+		return fmt.Errorf("reading file: %w", err)
 	}
-	defer fd.Close()
-
-	bs, err := io.ReadAll(fd)
+	journal, err := y.readJournal()
 	if err != nil {
-		log.Fatalf("reading file: %s", err)
-	}
-	var taskRecords = []TaskRecord{}
-	if err = json.Unmarshal(bs, &taskRecords); err != nil {
-		log.Fatalf("unmarshing: %s", err)
+		return err
 	}
+	taskRecords = append(taskRecords, journal...)
 
 	for _, rec := range taskRecords {
 		task, ok := y.taskKV[rec.Name]
-		if !ok {
+		// records from before checksums last changed are dropped, their
+		// checksums can't be compared with new ones
+		if !ok || rec.ChecksumVersion != checksumVersion {
 			continue
 		}
+		y.records[rec.Name] = rec
 		if len(rec.Checksum) > 0 {
-			loc := y.getCacheLoc(rec.Checksum)
-			if _, err := os.Lstat(loc); err == nil {
+			if _, err := os.Stat(y.getCacheLoc(rec.Checksum)); err == nil {
 				task.Checksum = rec.Checksum
-				path, err := os.Readlink(loc)
-				if err != nil {
-					log.Fatalf("restoring tasks: %s", err)
-				}
-				task.Out = path
-			}
-		}
-
-		task.Time = rec.Time
-		if task.Time > y.time {
-			y.time = task.Time
-		}
-
-		task.Dirty = len(task.Dep) != len(rec.Deps)
-		if !task.Dirty {
-			for i := range rec.Deps {
-				if task.Dep[i] != rec.Deps[i] {
-					task.Dirty = true
-					break
-				}
 			}
 		}
 
+		task.Duration = rec.Duration
 	}
+	return nil
 }
 
-func (y *Yabs) Prune() {
+// Prune removes outputs from the project's out dir that no target uses
+// anymore, once builds in the project have finished. The targets' outputs are
+// read from the records the last build saved. The cache is shared with other
+// projects so it's left alone.
+func (y *Yabs) Prune() error {
+	project, err := y.lockProject(context.Background())
+	if err != nil {
+		return err
+	}
+	defer project.Unlock()
+	if err := y.RestoreTasks(); err != nil {
+		return err
+	}
+
 	validOuts := map[string]bool{}
 	for _, t := range y.taskKV {
 		if len(t.Checksum) == 0 {
 			continue
 		}
-		cacheLoc := y.getCacheLoc(t.Checksum)
-		validOuts[cacheLoc] = true
-		path, err := os.Readlink(cacheLoc)
-		if err != nil {
-			log.Fatalf("prune: %s", err)
-		}
-		if filepath.IsAbs(path) {
-			wd, _ := os.Getwd()
-			path, _ = filepath.Rel(wd, path)
-		}
-		validOuts[path] = true
+		validOuts[filepath.Join(y.tmpDir, "out", t.Checksum)] = true
 	}
 
-	toDelete := []string{}
-	if err := filepath.WalkDir(".yabs/out", func(path string, d fs.DirEntry, err error) error {
-		if path == ".yabs/out" {
-			return nil
-		}
-		if !validOuts[path] {
-			toDelete = append(toDelete, path)
-		}
-		if d.IsDir() {
-			return filepath.SkipDir
-		}
-		return nil
-	}); err != nil {
-		log.Fatalf("prune: %s", err)
+	outDir := filepath.Join(y.tmpDir, "out")
+	entries, err := os.ReadDir(outDir)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("prune: %w", err)
 	}
-
-	if err := filepath.WalkDir(".yabs/cache", func(path string, d fs.DirEntry, err error) error {
-		if path == ".yabs/cache" || d.IsDir() {
-			return nil
-		}
-		if !validOuts[path] {
-			toDelete = append(toDelete, path)
+	for _, entry := range entries {
+		path := filepath.Join(outDir, entry.Name())
+		if validOuts[path] {
+			continue
 		}
-		return nil
-	}); err != nil {
-		log.Fatalf("prune: %s", err)
-	}
-
-	for _, path := range toDelete {
 		if err := os.RemoveAll(path); err != nil {
-			log.Fatalf("prune: %s", err)
-		}
-		dir := filepath.Dir(path)
-		if isEmptyDir(filepath.Dir(path)) {
-			if err := os.Remove(dir); err != nil {
-				log.Fatalf("removing parent: %s", err)
-			}
+			return fmt.Errorf("prune: %w", err)
 		}
 	}
+	return nil
 }
 
-func (y *Yabs) Register(name string, deps []string, fn BuildCtxFunc) {
+// Resource sets how many tasks can hold the named resource at once, by default
+// a resource can only be held by one task
+func (y *Yabs) Resource(name string, capacity int64) {
+	y.resources[name] = capacity
+}
+
+func (y *Yabs) Register(name string, deps []string, fn BuildCtxFunc, opts ...TaskOption) {
 	if _, ok := y.taskKV[name]; ok {
 		return
 	}
 
 	slices.Sort(deps)
 	task := &Task{Dep: deps, Fn: fn, Name: name}
+	for _, opt := range opts {
+		opt(task)
+	}
 	y.taskKV[name] = task
 }
 
-func (y *Yabs) ExecWithDefault(def string) error {
-	y.RestoreTasks()
-	y.time = y.time + 1
-	y.scheduler.Start()
-	if task, ok := y.taskKV[def]; ok {
-		<-y.scheduler.Schedule(task)
-	} else {
-		return fmt.Errorf("%q task not found", def)
-	}
-	y.SaveTasks()
+// SetFnHash sets the hash identifying a registered task's function, for
+// functions that can only be hashed once everything has been registered
+func (y *Yabs) SetFnHash(name, hash string) error {
+	task, ok := y.taskKV[name]
+	if !ok {
+		return fmt.Errorf("%q task not found", name)
+	}
+	task.FnHash = hash
 	return nil
 }
 
+// ExecWithDefault builds the target def and its dependencies, saving the
+// records of every target that completed. If any target fails, a *BuildError
+// is returned after the records are saved.
+func (y *Yabs) ExecWithDefault(def string) error {
+	return y.ExecTargetsContext(context.Background(), []string{def})
+}
+
+// ExecWithDefaultContext is like ExecWithDefault, cancelling ctx stops every
+// running target and skips the ones that haven't started
+func (y *Yabs) ExecWithDefaultContext(ctx context.Context, def string) error {
+	return y.ExecTargetsContext(ctx, []string{def})
+}
+
+// ExecTargets builds every target in one build, dependencies shared between
+// the targets only run once
+func (y *Yabs) ExecTargets(targets []string) error {
+	return y.ExecTargetsContext(context.Background(), targets)
+}
+
+// ExecTargetsContext is like ExecTargets, cancelling ctx stops every running
+// target and skips the ones that haven't started
+func (y *Yabs) ExecTargetsContext(ctx context.Context, targets []string) error {
+	if len(targets) == 0 {
+		return errors.New("no targets to build")
+	}
+	if err := y.Validate(targets...); err != nil {
+		return err
+	}
+	project, err := y.lockProject(ctx)
+	if err != nil {
+		return err
+	}
+	defer project.Unlock()
+	start := time.Now()
+	lk, err := y.cacheLock()
+	if err != nil {
+		return err
+	}
+	if err := lk.RLock(); err != nil {
+		return err
+	}
+	defer func() {
+		_ = lk.Unlock()
+		y.autoGC()
+	}()
+	if err := y.RestoreTasks(); err != nil {
+		return err
+	}
+	y.hashes = y.loadStatCache()
+	y.prioritize(targets...)
+	buildCtx := y.scheduler.Start(ctx)
+	defer y.scheduler.Stop()
+	chs := []<-chan *Task{}
+	for _, target := range targets {
+		ch := y.scheduler.Schedule(buildCtx, y.taskKV[target])
+		if y.scheduler.jobs == 1 {
+			<-ch
+			continue
+		}
+		chs = append(chs, ch)
+	}
+	for _, ch := range chs {
+		<-ch
+	}
+	if err := y.SaveTasks(); err != nil {
+		return err
+	}
+	if err := y.saveHistory(start, targets); err != nil {
+		return err
+	}
+	if err := y.saveStatCache(); err != nil {
+		return err
+	}
+	if y.KeepGoing {
+		y.printSummary()
+	}
+	if err := ctx.Err(); err != nil {
+		return fmt.Errorf("build interrupted: %w", err)
+	}
+	return y.buildError()
+}
+
 func (y *Yabs) GetTaskNames() []string {
 	names := []string{}
 	for name := range y.taskKV {
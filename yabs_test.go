@@ -1,7 +1,14 @@
 package yabs
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
 	"testing"
+	"time"
 
 	"golang.org/x/exp/slices"
 )
@@ -12,24 +19,22 @@ type getRecordsTest struct {
 	final []TaskRecord
 }
 
-const hiChecksum = "98ea6e4f216f2fb4b69fff9b3a44842c38686ca685f3f55dc48c5d3fb1107be4"
+const hiChecksum = "10e0fe7f02a52485bc3edf1fbe46d740e646b7935a644eaeaf6e1b0be0259a35"
 
 func TestGetTaskRecords(t *testing.T) {
 	tests := []getRecordsTest{
 		{
 			name: "no-op target returns empty TaskRecord",
 			input: func(y *Yabs) {
-				y.Register("default", []string{}, func(bc BuildCtx) {})
+				y.Register("default", []string{}, func(bc BuildCtx) error { return nil })
 			},
 			final: []TaskRecord{},
 		},
 		{
 			name: "one target produces out, no task dep",
 			input: func(y *Yabs) {
-				y.Register("default", []string{}, func(bc BuildCtx) {
-					if err := bc.Run("echo", "hi").StdoutToFile(bc.Out).Exec(); err != nil {
-						t.Fatal(err)
-					}
+				y.Register("default", []string{}, func(bc BuildCtx) error {
+					return bc.Run("echo", "hi").StdoutToFile(bc.Out).Exec()
 				})
 			},
 			final: []TaskRecord{{Name: "default", Checksum: hiChecksum}},
@@ -37,12 +42,10 @@ func TestGetTaskRecords(t *testing.T) {
 		{
 			name: "two targets",
 			input: func(y *Yabs) {
-				y.Register("echo", []string{}, func(bc BuildCtx) {
-					if err := bc.Run("echo", "hi").StdoutToFile(bc.Out).Exec(); err != nil {
-						t.Fatal(err)
-					}
+				y.Register("echo", []string{}, func(bc BuildCtx) error {
+					return bc.Run("echo", "hi").StdoutToFile(bc.Out).Exec()
 				})
-				y.Register("default", []string{"echo"}, func(bc BuildCtx) {})
+				y.Register("default", []string{"echo"}, func(bc BuildCtx) error { return nil })
 			},
 			final: []TaskRecord{{Name: "default", Deps: []string{"echo"}}, {Name: "echo", Checksum: hiChecksum}},
 		},
@@ -50,13 +53,15 @@ func TestGetTaskRecords(t *testing.T) {
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
+			chdirTemp(t)
 			y := New()
 
 			tt.input(y)
 
-			y.scheduler.Start()
+			ctx := y.scheduler.Start(context.Background())
+			defer y.scheduler.Stop()
 			if task, ok := y.taskKV["default"]; ok {
-				<-y.scheduler.Schedule(task)
+				<-y.scheduler.Schedule(ctx, task)
 			} else {
 				t.Fatalf("%q task not found", "default")
 			}
@@ -92,3 +97,542 @@ func compareTaskRecSlice(a, b []TaskRecord) bool {
 
 	return true
 }
+
+// chdirTemp runs the rest of the test inside a fresh temporary directory,
+// with its own cache
+func chdirTemp(t *testing.T) {
+	t.Helper()
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("YABS_CACHE_DIR", filepath.Join(dir, "cache"))
+	t.Cleanup(func() {
+		if err := os.Chdir(wd); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+func TestExecReportsFailures(t *testing.T) {
+	chdirTemp(t)
+
+	y := New()
+	y.Register("fail", []string{}, func(bc BuildCtx) error {
+		return errors.New("boom")
+	})
+	y.Register("default", []string{"fail"}, func(bc BuildCtx) error {
+		t.Error("dependent of a failed target should not run")
+		return nil
+	})
+
+	err := y.ExecWithDefault("default")
+
+	var buildErr *BuildError
+	if !errors.As(err, &buildErr) {
+		t.Fatalf("want *BuildError, got=%v", err)
+	}
+	if len(buildErr.Failed) != 1 || buildErr.Failed[0].Target != "fail" {
+		t.Fatalf("want \"fail\" to have failed, got=%+v", buildErr.Failed)
+	}
+	if slices.Compare(buildErr.Skipped, []string{"default"}) != 0 {
+		t.Fatalf("want \"default\" to be skipped, got=%v", buildErr.Skipped)
+	}
+	if _, err := os.Stat(".yabs/.records.json"); err != nil {
+		t.Fatalf("records should be saved after a failure: %s", err)
+	}
+}
+
+func TestKeepGoing(t *testing.T) {
+	for _, keepGoing := range []bool{false, true} {
+		t.Run(fmt.Sprintf("keep-going=%t", keepGoing), func(t *testing.T) {
+			chdirTemp(t)
+
+			y := New()
+			y.KeepGoing = keepGoing
+			y.Register("fail", []string{}, func(bc BuildCtx) error {
+				return errors.New("boom")
+			})
+			// gate holds back "ok" until "fail" has been marked as failed
+			y.Register("gate", []string{}, func(bc BuildCtx) error {
+				for {
+					y.scheduler.mu.Lock()
+					failed := y.scheduler.failed
+					y.scheduler.mu.Unlock()
+					if failed {
+						return nil
+					}
+					time.Sleep(time.Millisecond)
+				}
+			})
+			ran := false
+			y.Register("ok", []string{"gate"}, func(bc BuildCtx) error {
+				ran = true
+				return nil
+			})
+			y.Register("default", []string{"fail", "ok"}, func(bc BuildCtx) error { return nil })
+
+			var buildErr *BuildError
+			if err := y.ExecWithDefault("default"); !errors.As(err, &buildErr) {
+				t.Fatalf("want *BuildError, got=%v", err)
+			}
+
+			if ran != keepGoing {
+				t.Fatalf("want \"ok\" ran=%t, got=%t", keepGoing, ran)
+			}
+			if slices.Contains(buildErr.Skipped, "ok") == keepGoing {
+				t.Fatalf("want \"ok\" skipped=%t, got skipped=%v", !keepGoing, buildErr.Skipped)
+			}
+		})
+	}
+}
+
+func TestFailureCancelsRunningTargets(t *testing.T) {
+	chdirTemp(t)
+
+	y := New()
+	y.Register("fail", []string{}, func(bc BuildCtx) error {
+		return errors.New("boom")
+	})
+	y.Register("slow", []string{}, func(bc BuildCtx) error {
+		return bc.Run("sleep", "30").Exec()
+	})
+	y.Register("default", []string{"fail", "slow"}, func(bc BuildCtx) error { return nil })
+
+	start := time.Now()
+	var buildErr *BuildError
+	if err := y.ExecWithDefault("default"); !errors.As(err, &buildErr) {
+		t.Fatalf("want *BuildError, got=%v", err)
+	}
+	if time.Since(start) > 10*time.Second {
+		t.Fatalf("\"slow\" wasn't cancelled after \"fail\" failed")
+	}
+	if !slices.Contains(buildErr.Skipped, "slow") {
+		t.Fatalf("want \"slow\" to be skipped, got=%v", buildErr.Skipped)
+	}
+}
+
+func TestSingleJobOrder(t *testing.T) {
+	for i := 0; i < 10; i++ {
+		chdirTemp(t)
+
+		y := New()
+		y.Jobs = 1
+		order := []string{}
+		record := func(name string) BuildCtxFunc {
+			return func(bc BuildCtx) error {
+				order = append(order, name)
+				return nil
+			}
+		}
+		y.Register("default", []string{"b", "a"}, record("default"))
+		y.Register("a", []string{"d"}, record("a"))
+		y.Register("b", []string{"c", "d"}, record("b"))
+		y.Register("c", []string{}, record("c"))
+		y.Register("d", []string{}, record("d"))
+
+		if err := y.ExecWithDefault("default"); err != nil {
+			t.Fatal(err)
+		}
+
+		want := []string{"d", "a", "c", "b", "default"}
+		if slices.Compare(order, want) != 0 {
+			t.Fatalf("want order=%v, got=%v", want, order)
+		}
+	}
+}
+
+// concurrency records the most weight held at once by the targets running its
+// tasks
+type concurrency struct {
+	mu        sync.Mutex
+	used, max int64
+}
+
+// task holds weight for long enough to overlap with any target that could run
+// at the same time
+func (c *concurrency) task(weight int64) BuildCtxFunc {
+	return func(bc BuildCtx) error {
+		c.mu.Lock()
+		c.used += weight
+		if c.used > c.max {
+			c.max = c.used
+		}
+		c.mu.Unlock()
+		time.Sleep(10 * time.Millisecond)
+		c.mu.Lock()
+		c.used -= weight
+		c.mu.Unlock()
+		return nil
+	}
+}
+
+func TestResourcesLimitConcurrency(t *testing.T) {
+	chdirTemp(t)
+
+	y := New()
+	y.Jobs = 4
+	db := &concurrency{}
+	deps := []string{}
+	for i := 0; i < 4; i++ {
+		name := fmt.Sprintf("db%d", i)
+		deps = append(deps, name)
+		y.Register(name, []string{}, db.task(1), WithResources("db"))
+	}
+	y.Register("default", deps, func(bc BuildCtx) error { return nil })
+
+	if err := y.ExecWithDefault("default"); err != nil {
+		t.Fatal(err)
+	}
+	if db.max != 1 {
+		t.Fatalf("want at most 1 target using \"db\" at once, got=%d", db.max)
+	}
+}
+
+func TestWeightsLimitConcurrency(t *testing.T) {
+	chdirTemp(t)
+
+	y := New()
+	y.Jobs = 4
+	jobs := &concurrency{}
+	deps := []string{}
+	for i, weight := range []int64{3, 2, 2, 1, 1, 1} {
+		name := fmt.Sprintf("w%d", i)
+		deps = append(deps, name)
+		y.Register(name, []string{}, jobs.task(weight), WithWeight(weight))
+	}
+	y.Register("default", deps, func(bc BuildCtx) error { return nil })
+
+	if err := y.ExecWithDefault("default"); err != nil {
+		t.Fatal(err)
+	}
+	if jobs.max > 4 {
+		t.Fatalf("want at most 4 jobs' worth of weight running at once, got=%d", jobs.max)
+	}
+}
+
+func TestWeightAboveJobsIsClamped(t *testing.T) {
+	chdirTemp(t)
+
+	y := New()
+	y.Jobs = 2
+	running := &concurrency{}
+	y.Register("heavy", []string{}, running.task(1), WithWeight(5))
+	y.Register("light", []string{}, running.task(1))
+	y.Register("default", []string{"heavy", "light"}, func(bc BuildCtx) error { return nil })
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := y.ExecTargetsContext(ctx, []string{"default"}); err != nil {
+		t.Fatalf("want a target heavier than the pool to run: %s", err)
+	}
+	if running.max != 1 {
+		t.Fatalf("want the heavy target to take the whole pool, got %d running at once", running.max)
+	}
+}
+
+func TestExecTargetsSharesDeps(t *testing.T) {
+	chdirTemp(t)
+
+	y := New()
+	var mu sync.Mutex
+	runs := map[string]int{}
+	record := func(name string) BuildCtxFunc {
+		return func(bc BuildCtx) error {
+			mu.Lock()
+			runs[name]++
+			mu.Unlock()
+			return nil
+		}
+	}
+	y.Register("go_download", []string{}, record("go_download"))
+	y.Register("lint", []string{"go_download"}, record("lint"))
+	y.Register("test", []string{"go_download"}, record("test"))
+
+	if err := y.ExecTargets([]string{"lint", "test"}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"go_download", "lint", "test"} {
+		if runs[name] != 1 {
+			t.Errorf("want %q to run once, got=%d", name, runs[name])
+		}
+	}
+}
+
+func TestDryRun(t *testing.T) {
+	chdirTemp(t)
+
+	register := func(y *Yabs, buildDeps []string) {
+		y.Register("src", []string{}, func(bc BuildCtx) error {
+			return bc.Run("echo", "hi").StdoutToFile(bc.Out).Exec()
+		})
+		y.Register("lib", []string{"src"}, noop)
+		y.Register("docs", []string{}, noop)
+		y.Register("default", buildDeps, noop)
+	}
+
+	y := New()
+	register(y, []string{"lib"})
+	if err := y.ExecWithDefault("default"); err != nil {
+		t.Fatal(err)
+	}
+
+	y = New()
+	register(y, []string{"docs", "lib"})
+	plan, err := y.DryRun([]string{"default"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []PlannedTask{
+		{Target: "docs", Reason: Reason{Kind: NoRecord}},
+		{Target: "src", Reason: Reason{Kind: UpToDate}},
+		{Target: "lib", Reason: Reason{Kind: UpToDate}},
+		{Target: "default", Reason: Reason{Kind: DepsChanged}},
+	}
+	if !slices.Equal(plan, want) {
+		t.Fatalf("want plan=%+v, got=%+v", want, plan)
+	}
+}
+
+func TestDryRunPlansFs(t *testing.T) {
+	chdirTemp(t)
+
+	if err := os.MkdirAll("src", os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile("src/a.txt", []byte("a"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	register := func(y *Yabs) {
+		if _, err := Fs(y, "files", []string{"src/**"}, nil); err != nil {
+			t.Fatal(err)
+		}
+		y.Register("gen", []string{"files"}, func(bc BuildCtx) error {
+			return os.WriteFile(bc.Out, []byte("gen"), 0o644)
+		})
+	}
+	plan := func() []PlannedTask {
+		y := New()
+		register(y)
+		plan, err := y.DryRun([]string{"gen"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return plan
+	}
+	y := New()
+	register(y)
+	if err := y.ExecWithDefault("gen"); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []PlannedTask{
+		{Target: "files", Reason: Reason{Kind: AlwaysRuns}},
+		{Target: "gen", Reason: Reason{Kind: UpToDate}},
+	}
+	if got := plan(); !slices.Equal(got, want) {
+		t.Fatalf("want the unchanged files predicted, plan=%+v, got=%+v", want, got)
+	}
+	// a fresh checkout sharing the cache
+	if err := os.Rename(".yabs", "yabs.bak"); err != nil {
+		t.Fatal(err)
+	}
+	if got := plan(); !slices.Equal(got, want) {
+		t.Fatalf("want gen restored without records, plan=%+v, got=%+v", want, got)
+	}
+	if err := os.Rename("yabs.bak", ".yabs"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.WriteFile("src/a.txt", []byte("edited"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	want = []PlannedTask{
+		{Target: "files", Reason: Reason{Kind: AlwaysRuns}},
+		{Target: "gen", Reason: Reason{Kind: DepChanged, Dep: "files"}},
+	}
+	if got := plan(); !slices.Equal(got, want) {
+		t.Fatalf("want an edited file to rerun gen, plan=%+v, got=%+v", want, got)
+	}
+	y = New()
+	register(y)
+	if err := y.ExecWithDefault("gen"); err != nil {
+		t.Fatal(err)
+	}
+	if got := y.taskKV["gen"].Reason; got != want[1].Reason {
+		t.Fatalf("want the build to agree with the plan, got %s", got)
+	}
+}
+
+func TestDryRunUnplannedAlwaysRun(t *testing.T) {
+	chdirTemp(t)
+
+	register := func(y *Yabs) {
+		y.Register("stamp", []string{}, func(bc BuildCtx) error {
+			return os.WriteFile(bc.Out, []byte(time.Now().String()), 0o644)
+		}, WithAlwaysRun())
+		y.Register("gen", []string{"stamp"}, noop)
+	}
+	y := New()
+	register(y)
+	if err := y.ExecWithDefault("gen"); err != nil {
+		t.Fatal(err)
+	}
+
+	y = New()
+	register(y)
+	plan, err := y.DryRun([]string{"gen"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []PlannedTask{
+		{Target: "stamp", Reason: Reason{Kind: AlwaysRuns}},
+		{Target: "gen", Reason: Reason{Kind: DepWouldRun, Dep: "stamp"}},
+	}
+	if !slices.Equal(plan, want) {
+		t.Fatalf("want plan=%+v, got=%+v", want, plan)
+	}
+}
+
+func TestExplain(t *testing.T) {
+	chdirTemp(t)
+
+	y := New()
+	y.Register("src", []string{}, func(bc BuildCtx) error {
+		return bc.Run("echo", "hi").StdoutToFile(bc.Out).Exec()
+	}, WithFnHash("hi"))
+	y.Register("default", []string{"src"}, noop)
+	if err := y.ExecWithDefault("default"); err != nil {
+		t.Fatal(err)
+	}
+
+	explanations, err := y.Explain("default")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Explanation{{Target: "default", Recorded: true, Reason: Reason{Kind: NoRecord}}}
+	if !slices.Equal(explanations, want) {
+		t.Fatalf("want %+v, got=%+v", want, explanations)
+	}
+
+	y = New()
+	y.Register("src", []string{}, func(bc BuildCtx) error {
+		return bc.Run("echo", "changed").StdoutToFile(bc.Out).Exec()
+	}, WithFnHash("changed"))
+	y.Register("default", []string{"src"}, noop)
+	if err := y.ExecWithDefault("default"); err != nil {
+		t.Fatal(err)
+	}
+
+	explanations, err = y.Explain("default")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = []Explanation{
+		{Target: "default", Recorded: true, Reason: Reason{Kind: DepChanged, Dep: "src"}},
+		{Target: "src", Recorded: true, Reason: Reason{Kind: FnChanged}},
+	}
+	if !slices.Equal(explanations, want) {
+		t.Fatalf("want %+v, got=%+v", want, explanations)
+	}
+}
+
+func TestActionCache(t *testing.T) {
+	chdirTemp(t)
+
+	runs := map[string]int{}
+	depOut := ""
+	register := func(y *Yabs, hash string) {
+		y.Register("src", []string{}, func(bc BuildCtx) error {
+			runs["src"]++
+			return bc.Run("echo", hash).StdoutToFile(bc.Out).Exec()
+		}, WithFnHash(hash))
+		y.Register("always", []string{}, func(bc BuildCtx) error {
+			runs["always"]++
+			return nil
+		}, WithAlwaysRun())
+		y.Register("default", []string{"always", "src"}, func(bc BuildCtx) error {
+			runs["default"]++
+			return nil
+		})
+		y.Register("check", []string{"default", "src"}, func(bc BuildCtx) error {
+			depOut = bc.GetDep("src")
+			return nil
+		}, WithAlwaysRun())
+	}
+
+	for _, tt := range []struct {
+		hash string
+		want map[string]int
+	}{
+		{hash: "hi", want: map[string]int{"src": 1, "always": 1, "default": 1}},
+		{hash: "hi", want: map[string]int{"src": 1, "always": 2, "default": 1}},
+		{hash: "changed", want: map[string]int{"src": 2, "always": 3, "default": 2}},
+		// switching back restores the first run's results
+		{hash: "hi", want: map[string]int{"src": 2, "always": 4, "default": 2}},
+	} {
+		y := New()
+		register(y, tt.hash)
+		if err := y.ExecWithDefault("check"); err != nil {
+			t.Fatal(err)
+		}
+		for name, want := range tt.want {
+			if runs[name] != want {
+				t.Fatalf("hash=%s: want %q to have run %d times, got=%d", tt.hash, name, want, runs[name])
+			}
+		}
+		bs, err := os.ReadFile(depOut)
+		if err != nil {
+			t.Fatalf("hash=%s: reading restored output: %s", tt.hash, err)
+		}
+		if string(bs) != tt.hash+"\n" {
+			t.Fatalf("hash=%s: want output %q, got=%q", tt.hash, tt.hash+"\n", bs)
+		}
+	}
+}
+
+func TestEnvInputs(t *testing.T) {
+	chdirTemp(t)
+
+	runs := 0
+	build := func() {
+		y := New()
+		y.Register("default", []string{}, func(bc BuildCtx) error {
+			runs++
+			return bc.Run("echo", "hi").StdoutToFile(bc.Out).Exec()
+		}, WithEnv("YABS_TEST_ENV"))
+		if err := y.ExecWithDefault("default"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	t.Setenv("YABS_TEST_ENV", "a")
+	build()
+	build()
+	if runs != 1 {
+		t.Fatalf("want 1 run with the same env, got=%d", runs)
+	}
+
+	t.Setenv("YABS_TEST_ENV", "b")
+	build()
+	if runs != 2 {
+		t.Fatalf("want 2 runs after the env changed, got=%d", runs)
+	}
+
+	y := New()
+	y.Register("default", []string{}, noop, WithEnv("YABS_TEST_ENV"))
+	explanations, err := y.Explain("default")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Explanation{{Target: "default", Recorded: true, Reason: Reason{Kind: EnvChanged, Env: "YABS_TEST_ENV"}}}
+	if !slices.Equal(explanations, want) {
+		t.Fatalf("want %+v, got=%+v", want, explanations)
+	}
+}